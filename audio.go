@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type AudioTrack struct {
+	selector string
+	index    int
+	codec    string
+	bitrate  string
+}
+
+var defaultAudioTracks = []AudioTrack{{selector: "0", index: 0, codec: "aac", bitrate: "60k"}}
+
+// mp4CopyCodecs are the audio codecs the MP4 muxer can store as-is.
+var mp4CopyCodecs = map[string]bool{
+	"aac": true, "mp3": true, "mp2": true, "ac3": true, "eac3": true,
+	"alac": true, "opus": true, "flac": true, "dts": true,
+}
+
+// parseAudioTracks parses a comma-separated list of SELECTOR:CODEC[:BITRATE]
+// entries, where SELECTOR is a source audio track number or a language code.
+func parseAudioTracks(spec string) ([]AudioTrack, error) {
+	var tracks []AudioTrack
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid audio track %q, expected SELECTOR:CODEC[:BITRATE]", entry)
+		}
+
+		track := AudioTrack{selector: parts[0], index: -1, codec: parts[1]}
+		if index, err := strconv.Atoi(parts[0]); err == nil {
+			if index < 0 {
+				return nil, fmt.Errorf("invalid audio track number %d", index)
+			}
+			track.index = index
+		}
+		if len(parts) == 3 {
+			if track.codec == "copy" {
+				return nil, fmt.Errorf("audio track %q: bitrate cannot be set when copying", entry)
+			}
+			track.bitrate = parts[2]
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// withOriginalAudio puts a stream copy of each re-encoded track's source in
+// front of it, so the output carries both the original and compressed audio.
+func withOriginalAudio(tracks []AudioTrack) []AudioTrack {
+	copied := make(map[string]bool)
+	for _, track := range tracks {
+		if track.codec == "copy" {
+			copied[track.selector] = true
+		}
+	}
+
+	var result []AudioTrack
+	for _, track := range tracks {
+		if track.codec != "copy" && !copied[track.selector] {
+			original := track
+			original.codec = "copy"
+			original.bitrate = ""
+			result = append(result, original)
+			copied[track.selector] = true
+		}
+		result = append(result, track)
+	}
+	return result
+}
+
+// resolveAudioTracks checks the configured tracks against the source's audio
+// streams and resolves language selectors to the first matching track.
+func resolveAudioTracks(inputFile string, tracks []AudioTrack) ([]AudioTrack, error) {
+	streams, err := probeStreams(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	var audio []Stream
+	for _, stream := range streams {
+		if stream.CodecType == "audio" {
+			audio = append(audio, stream)
+		}
+	}
+
+	resolved := make([]AudioTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if track.index < 0 {
+			for i, stream := range audio {
+				if stream.Tags.Language == track.selector {
+					track.index = i
+					break
+				}
+			}
+			if track.index < 0 {
+				return nil, fmt.Errorf("no audio track with language %q", track.selector)
+			}
+		} else if track.index >= len(audio) {
+			return nil, fmt.Errorf("audio track %d requested, source has %d", track.index, len(audio))
+		}
+		if codec := audio[track.index].CodecName; track.codec == "copy" && !mp4CopyCodecs[codec] {
+			return nil, fmt.Errorf("audio track %s is %s, which cannot be copied into MP4", track.selector, codec)
+		}
+		resolved = append(resolved, track)
+	}
+	return resolved, nil
+}
+
+func audioArgs(tracks []AudioTrack) []string {
+	var maps, codecs []string
+	for i, track := range tracks {
+		maps = append(maps, "-map", "0:a:"+strconv.Itoa(track.index))
+		codecs = append(codecs, "-c:a:"+strconv.Itoa(i), track.codec)
+		if track.bitrate != "" {
+			codecs = append(codecs, "-b:a:"+strconv.Itoa(i), track.bitrate)
+		}
+	}
+	return append(maps, codecs...)
+}
+
+// validateFilterChain catches obvious mistakes in a filter chain before
+// ffmpeg sees it; ffmpeg itself does the real parsing.
+func validateFilterChain(chain string) error {
+	chain = strings.TrimSpace(chain)
+	if chain == "" {
+		return fmt.Errorf("filter chain is empty")
+	}
+	if strings.HasPrefix(chain, "-") {
+		return fmt.Errorf("filter chain %q looks like an ffmpeg option", chain)
+	}
+
+	depth := 0
+	var quote rune
+	for _, c := range chain {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced ']' in %q", chain)
+			}
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated quote in %q", chain)
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced '[' in %q", chain)
+	}
+	if strings.HasSuffix(chain, ",") || strings.Contains(chain, ",,") {
+		return fmt.Errorf("empty filter in %q", chain)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Codec struct {
+	preset      string
+	paramsFlag  string
+	levelParam  string
+	maxCRF      int
+	keyframes   bool
+	tuneSupport bool
+	profiles    []string
+	levels      []string
+}
+
+var codecs = map[string]Codec{
+	"libx265": {
+		preset: "medium", paramsFlag: "-x265-params", levelParam: "level-idc", maxCRF: 51, keyframes: true, tuneSupport: true,
+		profiles: []string{"main", "main10", "main12", "main422-10", "main444-8", "main444-10", "mainstillpicture"},
+		levels:   []string{"1", "2", "2.1", "3", "3.1", "4", "4.1", "5", "5.1", "5.2", "6", "6.1", "6.2"},
+	},
+	"libx264": {
+		preset: "slow", paramsFlag: "-x264-params", maxCRF: 51, keyframes: true, tuneSupport: true,
+		profiles: []string{"baseline", "main", "high", "high10", "high422", "high444"},
+		levels:   []string{"1", "1b", "1.1", "1.2", "1.3", "2", "2.1", "2.2", "3", "3.1", "3.2", "4", "4.1", "4.2", "5", "5.1", "5.2", "6", "6.1", "6.2"},
+	},
+	"libsvtav1": {preset: "6", paramsFlag: "-svtav1-params", maxCRF: 63},
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return Codec{}, fmt.Errorf("unsupported video codec %q, expected libx265, libx264 or libsvtav1", name)
+	}
+	return codec, nil
+}
+
+func validateProfileLevel(vcodec string, profile string, level string) error {
+	codec := codecs[vcodec]
+	if profile != "" && !contains(codec.profiles, profile) {
+		if len(codec.profiles) == 0 {
+			return fmt.Errorf("%s does not support setting the profile", vcodec)
+		}
+		return fmt.Errorf("invalid %s profile %q, expected one of %s", vcodec, profile, strings.Join(codec.profiles, ", "))
+	}
+	if level != "" && !contains(codec.levels, level) {
+		if len(codec.levels) == 0 {
+			return fmt.Errorf("%s does not support setting the level", vcodec)
+		}
+		return fmt.Errorf("invalid %s level %q, expected one of %s", vcodec, level, strings.Join(codec.levels, ", "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// profileLevel returns the profile and level to encode with: the device
+// preset's, overridden by -vprofile and -vlevel.
+func profileLevel(opts Options) (string, string) {
+	var profile, level string
+	if opts.device != nil {
+		profile, level = opts.device.profile, opts.device.level
+	}
+	if opts.vprofile != "" {
+		profile = opts.vprofile
+	}
+	if opts.vlevel != "" {
+		level = opts.vlevel
+	}
+	return profile, level
+}
+
+func videoCodecArgs(crf string, opts Options) []string {
+	codec := codecs[opts.vcodec]
+
+	preset := opts.preset
+	if preset == "" {
+		preset = codec.preset
+	}
+	args := []string{"-c:v", opts.vcodec, "-b:v", "0", "-crf", crf, "-preset", preset}
+
+	profile, level := profileLevel(opts)
+	if profile != "" {
+		args = append(args, "-profile:v", profile)
+	}
+	if level != "" && codec.levelParam == "" {
+		args = append(args, "-level", level)
+	}
+
+	if device := opts.device; device != nil {
+		args = append(args, "-pix_fmt", device.pixFmt)
+		if device.tag != "" {
+			args = append(args, "-tag:v", device.tag)
+		}
+	} else if opts.deband {
+		args = append(args, "-pix_fmt", "yuv420p10le")
+	}
+
+	if params := encoderParams(codec, opts); len(params) > 0 {
+		args = append(args, codec.paramsFlag, strings.Join(params, ":"))
+	}
+	if codec.tuneSupport {
+		args = append(args, "-tune", "animation")
+	}
+	return args
+}
+
+func encoderParams(codec Codec, opts Options) []string {
+	var params []string
+	if codec.keyframes {
+		params = append(params, "scenecut="+strconv.Itoa(opts.scenecut))
+		if opts.minKeyint > 0 {
+			params = append(params, "min-keyint="+strconv.Itoa(opts.minKeyint))
+		}
+	}
+	if _, level := profileLevel(opts); level != "" && codec.levelParam != "" {
+		params = append(params, codec.levelParam+"="+level)
+	}
+	if extra := opts.encoderParams[opts.vcodec]; extra != "" {
+		params = append(params, extra)
+	}
+	return params
+}
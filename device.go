@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type DeviceProfile struct {
+	profile   string
+	level     string
+	pixFmt    string
+	tag       string
+	faststart bool
+}
+
+var devices = map[string]map[string]DeviceProfile{
+	"appletv": {
+		"libx264": {profile: "high", level: "4.1", pixFmt: "yuv420p"},
+		"libx265": {profile: "main", level: "4.1", pixFmt: "yuv420p", tag: "hvc1"},
+	},
+	"android": {
+		"libx264": {profile: "main", level: "4.0", pixFmt: "yuv420p"},
+		"libx265": {profile: "main", level: "4.1", pixFmt: "yuv420p"},
+	},
+	"web": {
+		"libx264": {profile: "high", level: "4.0", pixFmt: "yuv420p", faststart: true},
+	},
+}
+
+func lookupDevice(device string, vcodec string) (DeviceProfile, error) {
+	profiles, ok := devices[device]
+	if !ok {
+		var names []string
+		for name := range devices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return DeviceProfile{}, fmt.Errorf("unknown device %q, expected one of %s", device, strings.Join(names, ", "))
+	}
+	profile, ok := profiles[vcodec]
+	if !ok {
+		var names []string
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return DeviceProfile{}, fmt.Errorf("device %q does not support %s, use -vcodec %s", device, vcodec, strings.Join(names, " or "))
+	}
+	return profile, nil
+}
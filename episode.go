@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const defaultEpisodeRegex = `(?i)^(?P<show>.*?)[ ._-]*S(?P<season>\d{1,2})[ ._-]*E(?P<episode>\d{1,3})`
+
+// Episode is what an -output-template is executed with.
+type Episode struct {
+	Show    string
+	Season  int
+	Episode int
+	UUID    string
+}
+
+func compileEpisodeRegex(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("season") < 0 || re.SubexpIndex("episode") < 0 {
+		return nil, fmt.Errorf("%q needs named groups (?P<season>...) and (?P<episode>...)", expr)
+	}
+	return re, nil
+}
+
+func parseOutputTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("output").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := episodeOutputPath(tmpl, Episode{Show: "Show", Season: 1, Episode: 1, UUID: "uuid"}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func parseEpisode(re *regexp.Regexp, name string) (Episode, bool) {
+	match := re.FindStringSubmatch(strings.TrimSuffix(name, filepath.Ext(name)))
+	if match == nil {
+		return Episode{}, false
+	}
+	season, err := strconv.Atoi(match[re.SubexpIndex("season")])
+	if err != nil {
+		return Episode{}, false
+	}
+	episode, err := strconv.Atoi(match[re.SubexpIndex("episode")])
+	if err != nil {
+		return Episode{}, false
+	}
+	var show string
+	if i := re.SubexpIndex("show"); i >= 0 {
+		show = strings.Join(strings.FieldsFunc(match[i], func(r rune) bool {
+			return r == '.' || r == '_' || r == ' '
+		}), " ")
+		show = strings.Trim(show, " -")
+	}
+	return Episode{Show: show, Season: season, Episode: episode}, true
+}
+
+// episodeOutputPath executes tmpl and returns the output path relative to
+// -out, without extension. It refuses paths that would leave -out.
+func episodeOutputPath(tmpl *template.Template, ep Episode) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ep); err != nil {
+		return "", err
+	}
+	path := filepath.Clean(filepath.FromSlash(strings.TrimSpace(buf.String())))
+	if path == "." || filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output template produced %q, which is not a path inside the output directory", buf.String())
+	}
+	for _, part := range strings.Split(path, string(filepath.Separator)) {
+		if part == "" || strings.TrimSpace(part) != part {
+			return "", fmt.Errorf("output template produced %q, which has an empty or padded path element", buf.String())
+		}
+	}
+	return path, nil
+}
+
+func templatedOutputFile(videoFile VideoFile, randomUUID string, opts Options) (string, error) {
+	ep, ok := parseEpisode(opts.episodeRegex, videoFile.name)
+	if !ok {
+		return "", fmt.Errorf("no season and episode in file name")
+	}
+	ep.UUID = randomUUID
+	path, err := episodeOutputPath(opts.outputTemplate, ep)
+	if err != nil {
+		return "", err
+	}
+	outputFile := filepath.Join(opts.outDir, path+".mp4")
+	if _, err := os.Stat(outputFile); err == nil {
+		return "", fmt.Errorf("%s already exists", outputFile)
+	}
+	return outputFile, nil
+}
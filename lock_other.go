@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+func acquireLock(path string) (func(), error) {
+	return func() {}, nil
+}
+
+func checkLock(path string) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".reencode.lock")
+
+	if err := checkLock(path); err != nil {
+		t.Fatalf("checkLock without a lock file: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkLock created %s", path)
+	}
+
+	release, err := acquireLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLock(path); err == nil {
+		t.Error("checkLock succeeded while the lock is held")
+	}
+	release()
+	if err := checkLock(path); err != nil {
+		t.Errorf("checkLock after release: %v", err)
+	}
+}
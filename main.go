@@ -3,156 +3,1257 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/schollz/progressbar/v3"
 	"golang.org/x/sync/semaphore"
 )
 
+const (
+	exitOK          = 0
+	exitFailures    = 1
+	exitAllFailed   = 2
+	exitUsage       = 3
+	exitInterrupted = 4
+)
+
+var errProbeFailed = errors.New("failed to probe bitrate for CRF selection")
+
+var errStillWriting = errors.New("file is still being written")
+
+var errKilled = errors.New("ffmpeg was killed by a signal, possibly by the OOM killer")
+
 type VideoFile struct {
 	path string
 	name string
 }
 
-type Sizes struct {
-	inSize  int64
-	outSize int64
+type Options struct {
+	inDir  string
+	outDir string
+	jobs   int
+	crf    string
+
+	crfCommand  string
+	onProbeFail string
+
+	vcodec        string
+	preset        string
+	encoderParams map[string]string
+	device        *DeviceProfile
+	vprofile      string
+	vlevel        string
+
+	scenecut  int
+	minKeyint int
+
+	deinterlace string
+	deband      bool
+
+	validateOutput    bool
+	durationTolerance time.Duration
+	frameTolerance    float64
+
+	maxMemory        int64
+	threadsMin       int
+	threadsMax       int
+	killRetryThreads int
+
+	stableInterval time.Duration
+	tmpDir         string
+	profileFFmpeg  bool
+
+	fps    string
+	copyTS bool
+
+	maxSize int64
+	minAge  int
+	maxAge  int
+
+	sidecar        bool
+	tagSource      bool
+	encodedSources map[string]string
+	sprites        time.Duration
+	shard          bool
+	episodeRegex   *regexp.Regexp
+	outputTemplate *template.Template
+
+	maxConsecutiveFailures int
+
+	statsFile  string
+	htmlReport string
+
+	pauseFile           string
+	progressLogInterval time.Duration
+
+	summaryJSON    string
+	compareSummary string
+
+	audioTracks  []AudioTrack
+	audioFilters string
+}
+
+type Result struct {
+	Source         string         `json:"source"`
+	Output         string         `json:"output"`
+	CRF            string         `json:"crf"`
+	Command        []string       `json:"command"`
+	InSize         int64          `json:"in_size"`
+	OutSize        int64          `json:"out_size"`
+	SourceDuration float64        `json:"source_duration,omitempty"`
+	EncodeSeconds  float64        `json:"encode_seconds"`
+	FFmpegProfile  *FFmpegProfile `json:"ffmpeg_profile,omitempty"`
+	SourceFrames   int64          `json:"source_frames,omitempty"`
+	OutputFrames   int64          `json:"output_frames,omitempty"`
+	DTSWarnings    int            `json:"dts_warnings,omitempty"`
+	Streams        []Stream       `json:"streams,omitempty"`
 }
 
 func main() {
-	inDir := flag.String("in", "", "Input directory path")
-	outDir := flag.String("out", "", "Output directory path")
-	flag.Parse()
+	os.Exit(run())
+}
+
+func run() int {
+	var opts Options
+	flag.StringVar(&opts.inDir, "in", "", "Input directory path (env REENCODE_IN)")
+	flag.StringVar(&opts.outDir, "out", "", "Output directory path (env REENCODE_OUT)")
+	flag.IntVar(&opts.jobs, "jobs", 4, "Number of concurrent encodes (env REENCODE_JOBS)")
+	flag.StringVar(&opts.crf, "crf", "", "Fixed CRF for all files instead of the bitrate-based one (env REENCODE_CRF)")
+	flag.StringVar(&opts.onProbeFail, "on-probe-fail", "default-crf", "What to do when a file's bitrate cannot be probed for CRF selection: default-crf (encode with CRF 24), skip or abort (env REENCODE_ON_PROBE_FAIL)")
+	flag.StringVar(&opts.vcodec, "vcodec", "libx265", "Video encoder: libx265, libx264 or libsvtav1 (env REENCODE_VCODEC)")
+	flag.StringVar(&opts.preset, "preset", "", "Encoder preset; defaults per codec: libx265=medium, libx264=slow, libsvtav1=6 (env REENCODE_PRESET)")
+	deviceName := flag.String("device", "", "Constrain profile, level and pixel format for a playback device: appletv, android or web (env REENCODE_DEVICE)")
+	flag.StringVar(&opts.vprofile, "vprofile", "", "Encoder profile, e.g. main10 for libx265 or high for libx264; overrides -device (env REENCODE_VPROFILE)")
+	flag.StringVar(&opts.vlevel, "vlevel", "", "Encoder level, e.g. 4.1; overrides -device; libx265 and libx264 only (env REENCODE_VLEVEL)")
+	flag.IntVar(&opts.scenecut, "scenecut", 40, "x265/x264 scene-cut threshold, 0 disables scene-cut keyframes (env REENCODE_SCENECUT)")
+	flag.IntVar(&opts.minKeyint, "min-keyint", 0, "x265/x264 minimum GOP length, 0 lets the encoder choose (env REENCODE_MIN_KEYINT)")
+	x265Params := flag.String("x265-params", "", "Extra x265 parameters (key=value:key=value) appended to the ones set by this tool; on conflicts these win (env REENCODE_X265_PARAMS)")
+	x264Params := flag.String("x264-params", "", "Extra x264 parameters, as -x265-params (env REENCODE_X264_PARAMS)")
+	svtav1Params := flag.String("svtav1-params", "", "Extra SVT-AV1 parameters, as -x265-params (env REENCODE_SVTAV1_PARAMS)")
+	flag.StringVar(&opts.deinterlace, "deinterlace", "auto", "Deinterlace with bwdif, one output frame per input frame so the frame rate is kept: auto (when ffprobe reports interlaced fields), on or off (env REENCODE_DEINTERLACE)")
+	flag.StringVar(&opts.crfCommand, "crf-command", "", "Program that gets the input file path as its argument and prints the CRF to use; falls back to the bitrate-based CRF on failure (env REENCODE_CRF_COMMAND)")
+	flag.BoolVar(&opts.deband, "deband", false, "Add a deband filter and encode 10-bit to avoid banding in gradients; with -device the device's 8-bit pixel format is kept (env REENCODE_DEBAND)")
+	flag.BoolVar(&opts.validateOutput, "validate-output", true, "Probe each output and discard it if it is shorter than the source (env REENCODE_VALIDATE_OUTPUT)")
+	flag.Float64Var(&opts.frameTolerance, "frame-tolerance", 0.01, "Fraction of the source's frames an output may be missing before it is considered broken, checked by -validate-output unless -fps is set (env REENCODE_FRAME_TOLERANCE)")
+	flag.DurationVar(&opts.durationTolerance, "duration-tolerance", 2*time.Second, "How much shorter than the source an output may be before it is considered truncated (env REENCODE_DURATION_TOLERANCE)")
+	flag.StringVar(&opts.fps, "fps", "", "Output frame rate, e.g. 30 or 30000/1001; unset keeps the source frame rate (env REENCODE_FPS)")
+	flag.BoolVar(&opts.sidecar, "sidecar", false, "Write a JSON file with encode details next to each output (env REENCODE_SIDECAR)")
+	flag.IntVar(&opts.maxConsecutiveFailures, "max-consecutive-failures", 0, "Stop starting new encodes after this many failures in a row, 0 never stops (env REENCODE_MAX_CONSECUTIVE_FAILURES)")
+	keepOriginalAudio := flag.Bool("keep-original-audio", false, "Also copy the source of every re-encoded audio track into the output, ahead of the compressed one (env REENCODE_KEEP_ORIGINAL_AUDIO)")
+	audioTracks := flag.String("audio-tracks", "", "Output audio tracks as SELECTOR:CODEC[:BITRATE],... where SELECTOR is a source audio track number or language, e.g. 0:copy,eng:aac:96k (default 0:aac:60k) (env REENCODE_AUDIO_TRACKS)")
+	flag.DurationVar(&opts.sprites, "sprites", 0, "Write thumbnail sprite sheets (up to 100 thumbnails each) and a WebVTT seek-preview track next to each output, one thumbnail per interval, e.g. 10s; 0 disables (env REENCODE_SPRITES)")
+	flag.BoolVar(&opts.tagSource, "tag-source", false, "Store the source's SHA-256 in each output's metadata and skip sources that an existing output in -out was made from (env REENCODE_TAG_SOURCE)")
+	flag.BoolVar(&opts.shard, "shard", false, "Put each output into a subdirectory named after the first two hex digits of its UUID (env REENCODE_SHARD)")
+	episodeRegex := flag.String("episode-regex", defaultEpisodeRegex, "Regular expression that extracts (?P<season>...), (?P<episode>...) and optionally (?P<show>...) from input file names for -output-template (env REENCODE_EPISODE_REGEX)")
+	outputTemplate := flag.String("output-template", "", "Go template for the output path inside -out, without extension, for files matched by -episode-regex, e.g. '{{.Show}}/Season {{printf \"%02d\" .Season}}/{{.Show}} S{{printf \"%02d\" .Season}}E{{printf \"%02d\" .Episode}}'; fields: Show, Season, Episode, UUID; other files keep the flat UUID name (env REENCODE_OUTPUT_TEMPLATE)")
+	flag.StringVar(&opts.statsFile, "stats-file", "stats.json", "File with cumulative statistics across runs, updated at the end of each run; empty disables it (env REENCODE_STATS_FILE)")
+	flag.StringVar(&opts.htmlReport, "html-report", "", "Write a self-contained HTML report of the run to this file (env REENCODE_HTML_REPORT)")
+	flag.StringVar(&opts.pauseFile, "pause-file", ".pause", "While this file exists, running encodes finish but no new ones start; empty disables (env REENCODE_PAUSE_FILE)")
+	flag.DurationVar(&opts.progressLogInterval, "progress-log-interval", 0, "Log a progress line (processed files and bytes saved) at this interval, e.g. 5m; 0 disables (env REENCODE_PROGRESS_LOG_INTERVAL)")
+	flag.StringVar(&opts.summaryJSON, "summary-json", "", "Write the run summary as JSON to this file (env REENCODE_SUMMARY_JSON)")
+	flag.StringVar(&opts.compareSummary, "compare-summary", "", "Print how this run compares to a summary written earlier with -summary-json (env REENCODE_COMPARE_SUMMARY)")
+	allowConcurrent := flag.Bool("allow-concurrent", false, "Run even if another instance holds the lock on the working directory")
+	crfRange := flag.String("crf-range", "", "Encode -sweep-file once per CRF in LOW-HIGH, e.g. 20-30, print the output sizes and exit")
+	crfStep := flag.Int("crf-step", 1, "CRF increment for -crf-range")
+	sweepFile := flag.String("sweep-file", "", "Source file to encode for -crf-range; -in and -out are not needed then")
+	flag.BoolVar(&opts.copyTS, "copy-ts", false, "Keep source timestamps (-copyts -avoid_negative_ts make_zero); use for sources that drift out of A/V sync after re-encoding (env REENCODE_COPY_TS)")
+	flag.StringVar(&opts.audioFilters, "af", "", "Audio filter chain passed to ffmpeg's -af for every output audio track; cannot be combined with copied tracks (env REENCODE_AF)")
+	quickScan := flag.Int("quick-scan", 0, "Estimate library-wide savings by encoding a 30s clip from every Nth file, print the estimate and exit")
+	preflight := flag.Bool("preflight", false, "Check flags, ffmpeg and ffprobe with the requested encoders and filters, the input and output directories, print what a run would do and exit; exits 0 only if every check passes")
+	scanOnly := flag.Bool("scan-only", false, "Probe every input file, print the library inventory as a JSON array and exit without encoding")
+	listStreamsOnly := flag.Bool("list-streams", false, "Print the streams of every input file and exit without encoding")
+	maxSize := flag.String("max-size", "", "Skip input files larger than this, e.g. 20G (env REENCODE_MAX_SIZE)")
+	flag.IntVar(&opts.minAge, "min-age", 0, "Skip input files modified less than this many days ago (env REENCODE_MIN_AGE)")
+	flag.IntVar(&opts.maxAge, "max-age", 0, "Skip input files modified more than this many days ago, 0 disables (env REENCODE_MAX_AGE)")
+	flag.DurationVar(&opts.stableInterval, "stable-interval", 0, "Before encoding, require a file's size to stay unchanged for this long, to skip files still being copied; 0 disables (env REENCODE_STABLE_INTERVAL)")
+	flag.StringVar(&opts.tmpDir, "tmp-dir", os.TempDir(), "Directory for per-encode working directories, used as ffmpeg's working directory (env REENCODE_TMP_DIR)")
+	flag.BoolVar(&opts.profileFFmpeg, "profile-ffmpeg", false, "Run ffmpeg with -benchmark and log CPU vs wall time, fps and speed per file; few busy cores point at storage or decoding as the bottleneck (env REENCODE_PROFILE_FFMPEG)")
+	maxMemory := flag.String("max-memory", "", "Memory budget for concurrent encodes, e.g. 8G; encodes whose estimated memory does not fit wait for running ones (env REENCODE_MAX_MEMORY)")
+	flag.IntVar(&opts.threadsMin, "threads-min", 2, "Fewest ffmpeg threads, used for low-resolution sources; threads scale with the probed resolution at 8 per 1080p frame (env REENCODE_THREADS_MIN)")
+	flag.IntVar(&opts.threadsMax, "threads-max", 16, "Most ffmpeg threads, used for 4K and larger sources or when the resolution cannot be probed (env REENCODE_THREADS_MAX)")
+	flag.IntVar(&opts.killRetryThreads, "kill-retry-threads", 4, "Retry an encode once with at most this many ffmpeg threads when ffmpeg is killed by a signal, e.g. by the OOM killer; 0 disables (env REENCODE_KILL_RETRY_THREADS)")
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
 
-	if *inDir == "" || *outDir == "" {
-		log.Fatalf("Input and output directory paths must be provided")
+	if err := applyEnvDefaults(); err != nil {
+		log.Printf("Invalid environment variable: %v", err)
+		return exitUsage
+	}
+
+	if *crfRange == "" && (opts.inDir == "" || (opts.outDir == "" && !*listStreamsOnly && !*scanOnly)) {
+		log.Printf("Input and output directory paths must be provided")
+		return exitUsage
+	}
+	for _, dir := range []*string{&opts.inDir, &opts.outDir} {
+		if *dir == "" {
+			continue
+		}
+		abs, err := normalizeDir(*dir)
+		if err != nil {
+			log.Printf("Failed to resolve path %q: %v", *dir, err)
+			return exitUsage
+		}
+		*dir = abs
+	}
+	if opts.jobs < 1 {
+		log.Printf("Number of jobs must be at least 1")
+		return exitUsage
+	}
+	if opts.frameTolerance < 0 || opts.frameTolerance > 1 {
+		log.Printf("Frame tolerance must be between 0 and 1")
+		return exitUsage
+	}
+	if opts.progressLogInterval < 0 {
+		log.Printf("Progress log interval must not be negative")
+		return exitUsage
+	}
+	if opts.stableInterval < 0 {
+		log.Printf("Stability interval must not be negative")
+		return exitUsage
+	}
+	if opts.sprites < 0 {
+		log.Printf("Sprite interval must not be negative")
+		return exitUsage
+	}
+	if opts.maxConsecutiveFailures < 0 {
+		log.Printf("Maximum consecutive failures must not be negative")
+		return exitUsage
+	}
+	if opts.threadsMin < 1 || opts.threadsMax < opts.threadsMin {
+		log.Printf("Invalid thread bounds: -threads-min must be at least 1 and not above -threads-max")
+		return exitUsage
+	}
+	if opts.killRetryThreads < 0 {
+		log.Printf("Kill retry threads must not be negative")
+		return exitUsage
+	}
+	if opts.scenecut < 0 || opts.minKeyint < 0 {
+		log.Printf("Scene-cut threshold and minimum keyint must not be negative")
+		return exitUsage
+	}
+	if *maxMemory != "" {
+		size, err := parseSize(*maxMemory)
+		if err != nil || size <= 0 {
+			log.Printf("Invalid memory budget %q", *maxMemory)
+			return exitUsage
+		}
+		opts.maxMemory = size
+	}
+	if *maxSize != "" {
+		size, err := parseSize(*maxSize)
+		if err != nil || size <= 0 {
+			log.Printf("Invalid maximum file size %q", *maxSize)
+			return exitUsage
+		}
+		opts.maxSize = size
+	}
+	opts.audioTracks = defaultAudioTracks
+	if *audioTracks != "" {
+		tracks, err := parseAudioTracks(*audioTracks)
+		if err != nil {
+			log.Printf("Invalid audio tracks: %v", err)
+			return exitUsage
+		}
+		opts.audioTracks = tracks
+	}
+	if *keepOriginalAudio {
+		opts.audioTracks = withOriginalAudio(opts.audioTracks)
+	}
+	if opts.minAge < 0 || opts.maxAge < 0 || (opts.maxAge > 0 && opts.minAge > opts.maxAge) {
+		log.Printf("File age bounds must not be negative and -min-age must not exceed -max-age")
+		return exitUsage
+	}
+	if opts.audioFilters != "" {
+		if err := validateFilterChain(opts.audioFilters); err != nil {
+			log.Printf("Invalid audio filter chain: %v", err)
+			return exitUsage
+		}
+		for _, track := range opts.audioTracks {
+			if track.codec == "copy" {
+				log.Printf("-af cannot be used when an audio track is copied (%s:copy)", track.selector)
+				return exitUsage
+			}
+		}
+	}
+	if opts.fps != "" {
+		if _, err := parseFrameRate(opts.fps); err != nil {
+			log.Printf("Invalid frame rate %q: %v", opts.fps, err)
+			return exitUsage
+		}
+	}
+	switch opts.onProbeFail {
+	case "default-crf", "skip", "abort":
+	default:
+		log.Printf("Probe failure policy must be default-crf, skip or abort, got %q", opts.onProbeFail)
+		return exitUsage
+	}
+	switch opts.deinterlace {
+	case "auto", "on", "off":
+	default:
+		log.Printf("Deinterlace mode must be auto, on or off, got %q", opts.deinterlace)
+		return exitUsage
+	}
+	codec, err := lookupCodec(opts.vcodec)
+	if err != nil {
+		log.Printf("Invalid video codec: %v", err)
+		return exitUsage
+	}
+	if *deviceName != "" {
+		device, err := lookupDevice(*deviceName, opts.vcodec)
+		if err != nil {
+			log.Printf("Invalid device: %v", err)
+			return exitUsage
+		}
+		opts.device = &device
+		if opts.deband {
+			log.Printf("-device %s requires %s, -deband will not switch to 10-bit output", *deviceName, device.pixFmt)
+		}
+	}
+	if err := validateProfileLevel(opts.vcodec, opts.vprofile, opts.vlevel); err != nil {
+		log.Printf("Invalid profile or level: %v", err)
+		return exitUsage
+	}
+	if *outputTemplate != "" {
+		re, err := compileEpisodeRegex(*episodeRegex)
+		if err != nil {
+			log.Printf("Invalid episode regex: %v", err)
+			return exitUsage
+		}
+		tmpl, err := parseOutputTemplate(*outputTemplate)
+		if err != nil {
+			log.Printf("Invalid output template: %v", err)
+			return exitUsage
+		}
+		opts.episodeRegex = re
+		opts.outputTemplate = tmpl
+	}
+	opts.encoderParams = map[string]string{"libx265": *x265Params, "libx264": *x264Params, "libsvtav1": *svtav1Params}
+	var crfLow, crfHigh int
+	if *quickScan < 0 {
+		log.Printf("Quick scan interval must not be negative")
+		return exitUsage
+	}
+	if *crfRange != "" {
+		crfLow, crfHigh, err = parseCRFRange(*crfRange, codec.maxCRF)
+		if err != nil {
+			log.Printf("Invalid CRF range: %v", err)
+			return exitUsage
+		}
+		if *crfStep < 1 {
+			log.Printf("CRF step must be at least 1")
+			return exitUsage
+		}
+		if *sweepFile == "" {
+			log.Printf("-crf-range needs -sweep-file naming the one source to encode")
+			return exitUsage
+		}
+		if info, err := os.Stat(*sweepFile); err != nil || !info.Mode().IsRegular() {
+			log.Printf("Invalid sweep file %q: not a readable regular file", *sweepFile)
+			return exitUsage
+		}
+	}
+	if opts.crf != "" {
+		if crf, err := strconv.Atoi(opts.crf); err != nil || crf < 0 || crf > codec.maxCRF {
+			log.Printf("CRF must be an integer between 0 and %d, got %q", codec.maxCRF, opts.crf)
+			return exitUsage
+		}
+	}
+
+	if *preflight {
+		return runPreflight(os.Stdout, opts, codec, *allowConcurrent)
+	}
+
+	if !*listStreamsOnly && !*scanOnly && *crfRange == "" {
+		if err := prepareOutputDir(opts.outDir); err != nil {
+			log.Printf("Invalid output directory: %v", err)
+			return exitUsage
+		}
+	}
+
+	if !*allowConcurrent {
+		release, err := acquireLock(".reencode.lock")
+		if err != nil {
+			log.Printf("Refusing to start: %v (use -allow-concurrent to override)", err)
+			return exitUsage
+		}
+		defer release()
 	}
 
 	logFile, err := os.OpenFile("logfile.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("Failed opening log file: %v", err)
+		log.Printf("Failed opening log file: %v", err)
+		return exitUsage
 	}
 	defer logFile.Close()
 
 	log.SetOutput(logFile)
 
-	videoFiles, err := findVideoFiles(*inDir)
+	if *crfRange != "" {
+		videoFile := VideoFile{path: *sweepFile, name: filepath.Base(*sweepFile)}
+		if err := runSweep(os.Stdout, videoFile, crfLow, crfHigh, *crfStep, opts); err != nil {
+			log.Printf("CRF sweep failed: %v", err)
+			return exitFailures
+		}
+		return exitOK
+	}
+
+	videoFiles, unreadable, err := findVideoFiles(opts.inDir, opts)
 	if err != nil {
-		log.Fatalf("Failed to find video files: %v", err)
+		log.Printf("Failed to find video files: %v", err)
+		return exitUsage
+	}
+	if len(videoFiles) == 0 {
+		if unreadable > 0 {
+			log.Printf("No readable video files in %s\n", opts.inDir)
+			return exitAllFailed
+		}
+		log.Printf("No video files to encode in %s, nothing to do\n", opts.inDir)
+		return exitOK
+	}
+
+	if *listStreamsOnly {
+		listStreams(os.Stdout, videoFiles)
+		return exitOK
+	}
+
+	if *scanOnly {
+		if err := scanLibrary(os.Stdout, videoFiles); err != nil {
+			log.Printf("Library scan failed: %v", err)
+			return exitFailures
+		}
+		return exitOK
+	}
+
+	if *quickScan > 0 {
+		if err := runQuickScan(os.Stdout, videoFiles, *quickScan, opts); err != nil {
+			log.Printf("Quick scan failed: %v", err)
+			return exitFailures
+		}
+		return exitOK
 	}
 
-	progressBar := progressbar.Default(int64(len(videoFiles)))
+	if opts.tagSource {
+		opts.encodedSources, err = indexEncodedSources(opts.outDir)
+		if err != nil {
+			log.Printf("Failed to index existing outputs: %v", err)
+			return exitUsage
+		}
+		log.Printf("Found %d tagged output(s) in %s\n", len(opts.encodedSources), opts.outDir)
+	}
+
+	progressBar := newProgressBar(int64(len(videoFiles)))
+	stopResizeWatch := watchResize(progressBar)
+	defer stopResizeWatch()
 
 	var wg sync.WaitGroup
-	sizesChan := make(chan Sizes, len(videoFiles))
+	resultsChan := make(chan Result, len(videoFiles))
 
-	concurrency := 4
-	sem := semaphore.NewWeighted(int64(concurrency))
+	sem := semaphore.NewWeighted(int64(opts.jobs))
+	var memSem *semaphore.Weighted
+	if opts.maxMemory > 0 {
+		memSem = semaphore.NewWeighted(opts.maxMemory / (1 << 20))
+	}
+
+	interruptCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-interruptCtx.Done()
+		// A second interrupt terminates immediately.
+		stop()
+	}()
+
+	ctx, cancel := context.WithCancel(interruptCtx)
+	defer cancel()
+	failures := &failureTracker{limit: opts.maxConsecutiveFailures}
+	var permissionFailed, stillWriting int64
+	var probeSkipped []string
+	var probeSkippedMu sync.Mutex
+	var processed, savedBytes int64
+
+	if opts.progressLogInterval > 0 {
+		ticker := time.NewTicker(opts.progressLogInterval)
+		defer ticker.Stop()
+		go func() {
+			for range ticker.C {
+				log.Printf("Progress: processed %d/%d, saved %s\n", atomic.LoadInt64(&processed), len(videoFiles), formatSize(atomic.LoadInt64(&savedBytes)))
+			}
+		}()
+	}
 
 	for _, videoFile := range videoFiles {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break
+		}
+		if opts.pauseFile != "" {
+			if err := waitWhilePaused(ctx, opts.pauseFile); err != nil {
+				sem.Release(1)
+				break
+			}
+		}
 		wg.Add(1)
-		sem.Acquire(context.Background(), 1)
 		go func(videoFile VideoFile) {
 			defer wg.Done()
-			encodeVideoFile(videoFile, progressBar, logFile, sizesChan, *outDir)
+			defer sem.Release(1)
+			if memSem != nil {
+				weight, err := reserveMemory(interruptCtx, memSem, videoFile, opts)
+				if err != nil {
+					return
+				}
+				defer memSem.Release(weight)
+			}
+			err := encodeVideoFile(interruptCtx, videoFile, progressBar, logFile, resultsChan, opts)
+			if interruptCtx.Err() != nil {
+				return
+			}
+			if errors.Is(err, fs.ErrPermission) {
+				atomic.AddInt64(&permissionFailed, 1)
+			}
 			progressBar.Add(1)
-			sem.Release(1)
+			atomic.AddInt64(&processed, 1)
+			if errors.Is(err, errProbeFailed) {
+				probeSkippedMu.Lock()
+				probeSkipped = append(probeSkipped, videoFile.path)
+				probeSkippedMu.Unlock()
+				if opts.onProbeFail == "abort" {
+					log.Printf("Aborting batch: %v\n", err)
+					cancel()
+				}
+				return
+			}
+			if errors.Is(err, errStillWriting) {
+				atomic.AddInt64(&stillWriting, 1)
+				return
+			}
+			if failures.record(err) {
+				log.Printf("Aborting batch: %d consecutive failures\n", failures.limit)
+				cancel()
+			}
 		}(videoFile)
 	}
 
 	go func() {
 		wg.Wait()
-		close(sizesChan)
+		close(resultsChan)
 	}()
 
+	var results []Result
 	var infileSizes []int64
 	var outfileSizes []int64
 
-	for sizes := range sizesChan {
-		infileSizes = append(infileSizes, sizes.inSize)
-		outfileSizes = append(outfileSizes, sizes.outSize)
+	for result := range resultsChan {
+		results = append(results, result)
+		infileSizes = append(infileSizes, result.InSize)
+		outfileSizes = append(outfileSizes, result.OutSize)
+		atomic.AddInt64(&savedBytes, result.InSize-result.OutSize)
+	}
+
+	interrupted := interruptCtx.Err() != nil
+	if interrupted {
+		fmt.Fprintln(os.Stderr)
+		log.Printf("Interrupted, %d of %d file(s) encoded\n", len(results), len(videoFiles))
+	} else {
+		progressBar.Finish()
+	}
+
+	if len(infileSizes) > 0 {
+		inmedian := calculateMedian(infileSizes)
+		outmedian := calculateMedian(outfileSizes)
+		fmt.Printf("Median in file size: %.2f bytes\nMedian out file size: %.2f", float64(inmedian/8/1024/1024), float64(outmedian/8/1024/1024))
+	}
+
+	if opts.statsFile != "" {
+		stats, err := updateLifetimeStats(opts.statsFile, results)
+		if err != nil {
+			log.Printf("Failed to update stats file: %s, error: %v\n", opts.statsFile, err)
+		} else {
+			fmt.Printf("\nLifetime: %d file(s) in %d run(s), %s saved\n", stats.FilesProcessed, stats.Runs, formatSize(stats.BytesIn-stats.BytesOut))
+		}
+	}
+
+	dtsWarned := 0
+	for _, result := range results {
+		if result.DTSWarnings > 0 {
+			dtsWarned++
+		}
+	}
+	if dtsWarned > 0 {
+		fmt.Printf("\nEncoded with non-monotonic DTS warnings: %d file(s); see logfile.log\n", dtsWarned)
+	}
+
+	if len(probeSkipped) > 0 {
+		if opts.onProbeFail == "abort" {
+			fmt.Printf("\nAborted: could not probe %s; see logfile.log\n", probeSkipped[0])
+		} else {
+			fmt.Printf("\nSkipped due to probe failure: %d file(s); see logfile.log\n", len(probeSkipped))
+		}
+	}
+
+	if stillWriting > 0 {
+		fmt.Printf("\nSkipped while still being written: %d file(s); see logfile.log\n", stillWriting)
+	}
+
+	summary := newSummary(results, failures.total)
+	summary.ProbeSkipped = probeSkipped
+	if opts.compareSummary != "" {
+		previous, err := loadSummary(opts.compareSummary)
+		if err != nil {
+			log.Printf("Failed to load summary to compare: %s, error: %v\n", opts.compareSummary, err)
+		} else {
+			printSummaryComparison(os.Stdout, previous, summary)
+		}
+	}
+	if opts.summaryJSON != "" {
+		if err := writeSummary(opts.summaryJSON, summary); err != nil {
+			log.Printf("Failed to write summary: %s, error: %v\n", opts.summaryJSON, err)
+		}
+	}
+
+	if opts.htmlReport != "" {
+		if err := writeHTMLReport(opts.htmlReport, results, probeSkipped); err != nil {
+			log.Printf("Failed to write HTML report: %s, error: %v\n", opts.htmlReport, err)
+		}
+	}
+
+	if unreadable > 0 {
+		fmt.Printf("\nSkipped due to permission denied: %d file(s); see logfile.log\n", unreadable)
+	}
+	if permissionFailed > 0 {
+		fmt.Printf("\nFailed with permission denied while encoding: %d file(s); see logfile.log\n", permissionFailed)
+	}
+
+	if interrupted {
+		fmt.Printf("\nInterrupted: %d of %d file(s) encoded, partial outputs removed\n", len(results), len(videoFiles))
 	}
 
-	inmedian := calculateMedian(infileSizes)
-	outmedian := calculateMedian(outfileSizes)
-	fmt.Printf("Median in file size: %.2f bytes\nMedian out file size: %.2f", float64(inmedian/8/1024/1024), float64(outmedian/8/1024/1024))
+	if failures.aborted {
+		fmt.Printf("\nAborted after %d consecutive failures, remaining files were not processed; see logfile.log\n", failures.limit)
+	}
+
+	switch failed := failures.total + len(probeSkipped) + unreadable; {
+	case interrupted:
+		return exitInterrupted
+	case failed == 0:
+		return exitOK
+	case len(results) == 0:
+		return exitAllFailed
+	default:
+		return exitFailures
+	}
+}
 
-	progressBar.Finish()
+type failureTracker struct {
+	mu          sync.Mutex
+	limit       int
+	consecutive int
+	total       int
+	aborted     bool
 }
 
-func findVideoFiles(path string) ([]VideoFile, error) {
-	var videoFiles []VideoFile
+func (t *failureTracker) record(err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		t.consecutive = 0
+		return false
+	}
+	t.consecutive++
+	t.total++
+	if t.limit > 0 && t.consecutive >= t.limit && !t.aborted {
+		t.aborted = true
+		return true
+	}
+	return false
+}
 
-	files, err := ioutil.ReadDir(path)
+func newProgressBar(max int64) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(
+		max,
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowIts(),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(os.Stderr, "\n")
+		}),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionUseANSICodes(true),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+}
+
+func applyEnvDefaults() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := "REENCODE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %v", name, setErr)
+		}
+	})
+	return err
+}
+
+func parseFrameRate(value string) (float64, error) {
+	num, den := value, "1"
+	if i := strings.Index(value, "/"); i >= 0 {
+		num, den = value[:i], value[i+1:]
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 || d <= 0 {
+		return 0, fmt.Errorf("frame rate must be positive")
 	}
+	return n / d, nil
+}
+
+func parseSize(value string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
 
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".mp4") {
-			videoFiles = append(videoFiles, VideoFile{path: path + "/" + file.Name(), name: file.Name()})
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSuffix(value, suffix)
+			multiplier = unit
+			break
 		}
 	}
 
-	if len(videoFiles) == 0 {
-		return nil, fmt.Errorf("no video files found in the directory")
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func reserveMemory(ctx context.Context, memSem *semaphore.Weighted, videoFile VideoFile, opts Options) (int64, error) {
+	budget := opts.maxMemory / (1 << 20)
+	weight := estimateEncodeMemory(videoFile.path) / (1 << 20)
+	if weight > budget {
+		weight = budget
+	}
+	log.Printf("Estimated %d MiB for encoding: %s\n", weight, videoFile.name)
+	if err := memSem.Acquire(ctx, weight); err != nil {
+		return 0, err
+	}
+	return weight, nil
+}
+
+func estimateEncodeMemory(inputFile string) int64 {
+	const (
+		baseMemory     = 256 << 20
+		bytesPerPixel  = 500
+		fallbackPixels = 1920 * 1080
+	)
+
+	pixels := int64(fallbackPixels)
+	width, height, err := probeResolution(inputFile)
+	if err != nil {
+		log.Printf("Failed to probe resolution for: %s, assuming 1080p, error: %v\n", inputFile, err)
+	} else {
+		pixels = int64(width) * int64(height)
+	}
+	return baseMemory + pixels*bytesPerPixel
+}
+
+func threadsForResolution(inputFile string, opts Options) int {
+	const pixelsPerThread = 1920 * 1080 / 8
+
+	width, height, err := probeResolution(inputFile)
+	if err != nil {
+		log.Printf("Failed to probe resolution for: %s, using %d threads, error: %v\n", inputFile, opts.threadsMax, err)
+		return opts.threadsMax
+	}
+	threads := (width*height + pixelsPerThread - 1) / pixelsPerThread
+	if threads < opts.threadsMin {
+		threads = opts.threadsMin
+	}
+	if threads > opts.threadsMax {
+		threads = opts.threadsMax
+	}
+	return threads
+}
+
+func probeResolution(inputFile string) (int, int, error) {
+	output, err := probeVideoStream(inputFile, "width,height")
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected ffprobe output: %q", output)
+	}
+	width, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+func prepareOutputDir(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s exists and is not a directory", path)
+	}
+
+	return checkWritable(path)
+}
+
+// normalizeDir makes a directory flag absolute and drops trailing
+// separators, so paths built from it and written to logs are stable.
+func normalizeDir(dir string) (string, error) {
+	return filepath.Abs(dir)
+}
+
+func findVideoFiles(path string, opts Options) ([]VideoFile, int, error) {
+	var videoFiles []VideoFile
+	unreadable := 0
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".mp4") {
+			file, err := entry.Info()
+			if err == nil {
+				err = checkReadable(filepath.Join(path, entry.Name()))
+			}
+			if err != nil {
+				if errors.Is(err, fs.ErrPermission) {
+					unreadable++
+				}
+				log.Printf("Skipping file: %s, error: %v\n", entry.Name(), err)
+				continue
+			}
+			if opts.maxSize > 0 && file.Size() > opts.maxSize {
+				log.Printf("Skipping file: %s, size %s is above -max-size\n", file.Name(), formatSize(file.Size()))
+				continue
+			}
+			age := time.Since(file.ModTime())
+			if opts.minAge > 0 && age < time.Duration(opts.minAge)*24*time.Hour {
+				log.Printf("Skipping file: %s, modified %.1f days ago is newer than -min-age\n", file.Name(), age.Hours()/24)
+				continue
+			}
+			if opts.maxAge > 0 && age > time.Duration(opts.maxAge)*24*time.Hour {
+				log.Printf("Skipping file: %s, modified %.1f days ago is older than -max-age\n", file.Name(), age.Hours()/24)
+				continue
+			}
+			videoFiles = append(videoFiles, VideoFile{path: filepath.Join(path, file.Name()), name: file.Name()})
+		}
 	}
 
 	log.Printf("Found %d video(s)", len(videoFiles))
 
-	return videoFiles, nil
+	return videoFiles, unreadable, nil
 }
 
-func encodeVideoFile(videoFile VideoFile, progressBar *progressbar.ProgressBar, logFile *os.File, sizesChan chan<- Sizes, outDir string) {
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func encodeVideoFile(ctx context.Context, videoFile VideoFile, progressBar *progressbar.ProgressBar, logFile *os.File, resultsChan chan<- Result, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	log.Printf("Starting encoding for file: %s\n", videoFile.name)
 
-	crf := calculateCRF(videoFile.path)
+	if opts.stableInterval > 0 {
+		if err := waitStable(videoFile.path, opts.stableInterval); err != nil {
+			log.Printf("Skipping file: %s, error: %v\n", videoFile.path, err)
+			return err
+		}
+	}
+
+	var sourceHash string
+	if opts.tagSource {
+		var err error
+		sourceHash, err = hashFile(videoFile.path)
+		if err != nil {
+			log.Printf("Failed to hash file: %s, error: %v\n", videoFile.path, err)
+			return err
+		}
+		if output, ok := opts.encodedSources[sourceHash]; ok {
+			log.Printf("Skipping file: %s, already encoded as %s\n", videoFile.path, output)
+			return nil
+		}
+	}
+
+	crf, err := chooseCRF(videoFile.path, opts)
+	if err != nil {
+		log.Printf("Skipping file: %s, error: %v\n", videoFile.path, err)
+		return err
+	}
 
 	randomUUID := uuid.New().String()
-	outputFile := outDir + "/" + randomUUID + ".mp4"
+	outputDir := opts.outDir
+	if opts.shard {
+		outputDir = filepath.Join(outputDir, randomUUID[:2])
+	}
+	outputFile := filepath.Join(outputDir, randomUUID+".mp4")
+	if opts.outputTemplate != nil {
+		if path, err := templatedOutputFile(videoFile, randomUUID, opts); err != nil {
+			log.Printf("Using flat output name for: %s, error: %v\n", videoFile.path, err)
+		} else {
+			outputFile = path
+			outputDir = filepath.Dir(path)
+		}
+	}
 
-	if err := runFFMPEGCommand(videoFile.path, crf, outputFile); err != nil {
-		log.Printf("Failed to encode file: %s, error: %v\n", videoFile.path, err)
-		return
+	if err := checkPathLength(outputFile); err != nil {
+		log.Printf("Skipping file: %s, error: %v\n", videoFile.path, err)
+		return err
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		log.Printf("Failed to create output directory: %s, error: %v\n", outputDir, err)
+		return err
+	}
+
+	audio, err := resolveAudioTracks(videoFile.path, opts.audioTracks)
+	if err != nil {
+		log.Printf("Skipping file: %s, error: %v\n", videoFile.path, err)
+		return err
+	}
+
+	filters := videoFilters(videoFile.path, opts)
+	var metadata map[string]string
+	if sourceHash != "" {
+		metadata = map[string]string{sourceHashTag: sourceHash}
+	}
+	args := ffmpegArgs(videoFile.path, crf, outputFile, filters, audio, metadata, opts)
+
+	workDir, err := os.MkdirTemp(opts.tmpDir, "reenc-job-")
+	if err != nil {
+		log.Printf("Failed to create working directory for: %s, error: %v\n", videoFile.path, err)
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	if opts.profileFFmpeg {
+		args = append([]string{"-benchmark"}, args...)
+	}
+
+	start := time.Now()
+	stderr, err := runFFMPEGCommand(ctx, workDir, args)
+	if errors.Is(err, errKilled) && opts.killRetryThreads > 0 {
+		log.Printf("ffmpeg was killed while encoding: %s, retrying with at most %d threads, error: %v\n", videoFile.path, opts.killRetryThreads, err)
+		if err := os.Remove(outputFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println(err)
+		}
+		args = withThreads(args, opts.killRetryThreads)
+		stderr, err = runFFMPEGCommand(ctx, workDir, args)
+	}
+	if err != nil {
+		if errors.Is(err, errKilled) {
+			log.Printf("Failed to encode file: %s, ffmpeg was killed, error: %v\n", videoFile.path, err)
+		} else {
+			log.Printf("Failed to encode file: %s, error: %v\n", videoFile.path, err)
+		}
+		if err := os.Remove(outputFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println(err)
+		}
+		return err
+	}
+
+	var inFrames, outFrames int64
+	if opts.validateOutput {
+		inFrames, outFrames, err = validateOutput(videoFile.path, outputFile, opts)
+		if err != nil {
+			log.Printf("Discarding invalid output: %s for file: %s, error: %v\n", outputFile, videoFile.path, err)
+			if err := os.Remove(outputFile); err != nil {
+				log.Println(err)
+			}
+			return err
+		}
 	}
 
 	insize, outsize, err := getFileSizes(videoFile.path, outputFile)
 	if err != nil {
 		log.Printf("Failed to get file sizes for: %s and %s, error: %v\n", videoFile.path, outputFile, err)
-		return
+		return err
 	}
 
-	sizesChan <- Sizes{insize, outsize}
+	result := Result{
+		Source:        videoFile.path,
+		Output:        outputFile,
+		CRF:           crf,
+		Command:       append([]string{"ffmpeg"}, args...),
+		InSize:        insize,
+		OutSize:       outsize,
+		EncodeSeconds: time.Since(start).Seconds(),
+		SourceFrames:  inFrames,
+		OutputFrames:  outFrames,
+		DTSWarnings:   countDTSWarnings(stderr),
+	}
+	if result.DTSWarnings > 0 {
+		log.Printf("Encoded with %d non-monotonic DTS warning(s), check for glitches: %s\n", result.DTSWarnings, videoFile.path)
+	}
 
-	progressBar.Add(1)
+	if opts.profileFFmpeg {
+		if profile := parseFFmpegProfile(stderr); profile != nil {
+			result.FFmpegProfile = profile
+			log.Printf("ffmpeg profile for: %s, cpu %.1fs (user %.1fs, sys %.1fs), wall %.1fs, %.1f cores busy, %.1f fps, %.2fx\n",
+				videoFile.name, profile.UserSeconds+profile.SystemSeconds, profile.UserSeconds, profile.SystemSeconds, profile.RealSeconds, profile.CoresBusy, profile.FPS, profile.Speed)
+		}
+	}
 
-	writeReference(videoFile.name, outputFile)
+	if opts.sidecar {
+		writeSidecar(result)
+	}
+
+	if opts.sprites > 0 {
+		if err := writeSprites(outputFile, opts.sprites); err != nil {
+			log.Printf("Failed to write thumbnail sprites for: %s, error: %v\n", outputFile, err)
+		}
+	}
+
+	resultsChan <- result
+
+	writeReference(videoFile.name, outputFile, inFrames, outFrames)
+
+	return nil
 }
 
-func writeReference(inputName string, outputName string) {
+func writeSidecar(result Result) {
+	if duration, err := probeDuration(result.Source); err == nil {
+		result.SourceDuration = duration
+	}
+	if streams, err := probeStreams(result.Source); err == nil {
+		result.Streams = streams
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sidecarFile := strings.TrimSuffix(result.Output, filepath.Ext(result.Output)) + ".json"
+	if err := ioutil.WriteFile(sidecarFile, append(data, '\n'), 0644); err != nil {
+		log.Printf("Failed to write sidecar: %s, error: %v\n", sidecarFile, err)
+	}
+}
+
+func waitStable(path string, interval time.Duration) error {
+	before, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	time.Sleep(interval)
+	after, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		return fmt.Errorf("%w, size changed from %d to %d bytes in %s", errStillWriting, before.Size(), after.Size(), interval)
+	}
+	return nil
+}
+
+func checkPathLength(path string) error {
+	if len(path) > maxPathLength {
+		return fmt.Errorf("path is longer than %d bytes: %s", maxPathLength, path)
+	}
+	for _, name := range strings.Split(path, string(filepath.Separator)) {
+		if len(name) > maxNameLength {
+			return fmt.Errorf("path component %q is longer than %d bytes: %s", name, maxNameLength, path)
+		}
+	}
+	return nil
+}
+
+// writeReference appends "input - output" to reference.txt, followed by the
+// source and output frame counts when -validate-output counted them.
+func writeReference(inputName string, outputName string, inFrames, outFrames int64) {
+	line := inputName + " - " + outputName
+	if inFrames > 0 && outFrames > 0 {
+		line += fmt.Sprintf(" (frames: %d -> %d)", inFrames, outFrames)
+	}
 	f, err := os.OpenFile("reference.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer f.Close()
-	if _, err := f.WriteString(inputName + " - " + outputName + "\n"); err != nil {
+	if _, err := f.WriteString(line + "\n"); err != nil {
 		log.Println(err)
 		return
 	}
 }
 
+func validateOutput(inputFile string, outputFile string, opts Options) (int64, int64, error) {
+	if err := checkDuration(inputFile, outputFile, opts.durationTolerance); err != nil {
+		return 0, 0, err
+	}
+
+	inFrames, err := probeFrameCount(inputFile)
+	if err != nil {
+		log.Printf("Skipping frame count check, failed to count frames of: %s, error: %v\n", inputFile, err)
+		return 0, 0, nil
+	}
+	outFrames, err := probeFrameCount(outputFile)
+	if err != nil {
+		return inFrames, 0, err
+	}
+
+	// A changed frame rate changes the frame count on purpose.
+	if opts.fps == "" && float64(inFrames-outFrames) > float64(inFrames)*opts.frameTolerance {
+		return inFrames, outFrames, fmt.Errorf("output has %d frames, source has %d", outFrames, inFrames)
+	}
+	return inFrames, outFrames, nil
+}
+
+func checkDuration(inputFile string, outputFile string, tolerance time.Duration) error {
+	inDuration, err := probeDuration(inputFile)
+	if err != nil {
+		log.Printf("Skipping duration check, failed to probe duration of: %s, error: %v\n", inputFile, err)
+		return nil
+	}
+	outDuration, err := probeDuration(outputFile)
+	if err != nil {
+		return err
+	}
+
+	if inDuration-outDuration > tolerance.Seconds() {
+		return fmt.Errorf("output is %.2fs long, source is %.2fs", outDuration, inDuration)
+	}
+	return nil
+}
+
+func probeFrameCount(inputFile string) (int64, error) {
+	if output, err := probeVideoStream(inputFile, "nb_frames"); err == nil {
+		if frames, err := strconv.ParseInt(output, 10, 64); err == nil && frames > 0 {
+			return frames, nil
+		}
+	}
+
+	cmd := exec.Command("ffprobe", "-v", "error", "-count_packets", "-select_streams", "v:0", "-show_entries", "stream=nb_read_packets", "-of", "default=noprint_wrappers=1:nokey=1", filepath.Clean(inputFile))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	frames, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse frame count: %v", err)
+	}
+	return frames, nil
+}
+
+func probeDuration(inputFile string) (float64, error) {
+	if output, err := probeVideoStream(inputFile, "duration"); err == nil {
+		if duration, ok := parseDuration(output); ok {
+			return duration, nil
+		}
+	}
+
+	output, err := probeFormat(inputFile, "duration")
+	if err != nil {
+		return 0, err
+	}
+
+	duration, ok := parseDuration(output)
+	if !ok {
+		return 0, fmt.Errorf("no duration in stream or format: %q", output)
+	}
+	return duration, nil
+}
+
+func probeFormat(inputFile string, entry string) (string, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format="+entry, "-of", "default=noprint_wrappers=1:nokey=1", filepath.Clean(inputFile))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func parseDuration(output string) (float64, bool) {
+	duration, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+	if err != nil || duration <= 0 {
+		return 0, false
+	}
+	return duration, true
+}
+
 func getFileSizes(inputFile string, outputFile string) (int64, int64, error) {
 	inFileInfo, err := os.Stat(inputFile)
 	if err != nil {
@@ -165,40 +1266,216 @@ func getFileSizes(inputFile string, outputFile string) (int64, int64, error) {
 	return inFileInfo.Size(), outFileInfo.Size(), nil
 }
 
-func runFFMPEGCommand(inputFile string, crf string, outputFile string) error {
-	cmd := exec.Command("ffmpeg", "-i", inputFile, "-map", "0:v:0", "-map", "0:a:0", "-c:v", "libx265", "-b:v", "0", "-crf", crf, "-preset", "medium", "-c:a", "aac", "-b:a", "60k", "-tune", "animation", "-threads", "16", outputFile)
+func ffmpegArgs(inputFile string, crf string, outputFile string, filters []string, audio []AudioTrack, metadata map[string]string, opts Options) []string {
+	var args []string
+	if opts.copyTS {
+		args = append(args, "-copyts")
+	}
+	args = append(args, "-i", inputFile, "-map", "0:v:0")
+	args = append(args, audioArgs(audio)...)
+	if opts.audioFilters != "" {
+		args = append(args, "-af", opts.audioFilters)
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	if opts.fps != "" {
+		args = append(args, "-r", opts.fps)
+	}
+	args = append(args, videoCodecArgs(crf, opts)...)
+	if opts.copyTS {
+		args = append(args, "-avoid_negative_ts", "make_zero")
+	}
+	for key, value := range metadata {
+		args = append(args, "-metadata", key+"="+value)
+	}
+	var movflags []string
+	if opts.device != nil && opts.device.faststart {
+		movflags = append(movflags, "+faststart")
+	}
+	if opts.tagSource {
+		movflags = append(movflags, "+use_metadata_tags")
+	}
+	if len(movflags) > 0 {
+		args = append(args, "-movflags", strings.Join(movflags, ""))
+	}
+	args = append(args, "-threads", strconv.Itoa(threadsForResolution(inputFile, opts)), outputFile)
+	return args
+}
+
+func videoFilters(inputFile string, opts Options) []string {
+	var filters []string
+
+	deinterlace := opts.deinterlace == "on"
+	if opts.deinterlace == "auto" {
+		interlaced, err := isInterlaced(inputFile)
+		if err != nil {
+			log.Printf("Failed to probe field order for: %s, error: %v\n", inputFile, err)
+		}
+		deinterlace = interlaced
+	}
+	// Deinterlacing has to see the original fields, so it always goes first.
+	if deinterlace {
+		filters = append(filters, "bwdif=mode=send_frame")
+	}
+	if opts.deband {
+		filters = append(filters, "deband")
+	}
+
+	return filters
+}
+
+func isInterlaced(inputFile string) (bool, error) {
+	fieldOrder, err := probeVideoStream(inputFile, "field_order")
+	if err != nil {
+		return false, err
+	}
+	switch fieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func probeVideoStream(inputFile string, entry string) (string, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream="+entry, "-of", "default=noprint_wrappers=1:nokey=1", filepath.Clean(inputFile))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func runFFMPEGCommand(ctx context.Context, dir string, args []string) (string, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Dir = dir
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run()
 
 	if err != nil {
 		log.Printf("ffmpeg stderr:\n%s\n", stderr.String())
-		return err
+		var exitErr *exec.ExitError
+		if ctx.Err() == nil && errors.As(err, &exitErr) {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				return stderr.String(), fmt.Errorf("%w: %v", errKilled, status.Signal())
+			}
+		}
+		if strings.Contains(stderr.String(), "Permission denied") {
+			return stderr.String(), fmt.Errorf("%v: %w", err, fs.ErrPermission)
+		}
+		return stderr.String(), err
 	}
 
-	return nil
+	return stderr.String(), nil
 }
 
-func calculateCRF(inputFile string) string {
-	inputFile = filepath.Clean(inputFile)
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=bit_rate", "-of", "default=noprint_wrappers=1:nokey=1", inputFile)
+func withThreads(args []string, threads int) []string {
+	out := append([]string(nil), args...)
+	for i := 0; i+1 < len(out); i++ {
+		if n, err := strconv.Atoi(out[i+1]); err == nil && out[i] == "-threads" && n > threads {
+			out[i+1] = strconv.Itoa(threads)
+		}
+	}
+	return out
+}
+
+func countDTSWarnings(stderr string) int {
+	count := 0
+	for _, line := range strings.Split(stderr, "\n") {
+		if strings.Contains(line, "Non-monotonous DTS") || strings.Contains(line, "Non-monotonic DTS") {
+			count++
+		}
+	}
+	return count
+}
+
+func chooseCRF(inputFile string, opts Options) (string, error) {
+	if opts.crf != "" {
+		return opts.crf, nil
+	}
+	if opts.crfCommand != "" {
+		crf, err := runCRFCommand(opts.crfCommand, inputFile, codecs[opts.vcodec].maxCRF)
+		if err == nil {
+			return crf, nil
+		}
+		log.Printf("CRF command failed for: %s, falling back to bitrate-based CRF, error: %v\n", inputFile, err)
+	}
+
+	crf, err := calculateCRF(inputFile)
+	if err != nil {
+		if opts.onProbeFail == "default-crf" {
+			log.Printf("Failed to determine video bitrate for: %s, using CRF %s, error: %v\n", inputFile, crf, err)
+			return crf, nil
+		}
+		return "", fmt.Errorf("%w: %v", errProbeFailed, err)
+	}
+	return crf, nil
+}
+
+func runCRFCommand(command string, inputFile string, maxCRF int) (string, error) {
+	cmd := exec.Command(command, inputFile)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	output, err := cmd.CombinedOutput()
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
 
+	crf, err := strconv.Atoi(strings.TrimSpace(string(output)))
 	if err != nil {
-		log.Printf("ffprobe stderr:\n%s\n", stderr.String())
-		return "28"
+		return "", fmt.Errorf("output is not an integer: %q", strings.TrimSpace(string(output)))
+	}
+	if crf < 0 || crf > maxCRF {
+		return "", fmt.Errorf("CRF %d is out of range 0-%d", crf, maxCRF)
+	}
+	return strconv.Itoa(crf), nil
+}
+
+func calculateCRF(inputFile string) (string, error) {
+	bitrate, err := probeBitrate(inputFile)
+	if err != nil {
+		return "24", err
+	}
+	return crfForBitrate(bitrate), nil
+}
+
+func probeBitrate(inputFile string) (int, error) {
+	if output, err := probeVideoStream(inputFile, "bit_rate"); err == nil {
+		if bitrate, ok := parseBitrate(output); ok {
+			return bitrate, nil
+		}
 	}
 
-	bitrateStr := strings.Trim(string(output), "\n")
-	bitrate, err := strconv.Atoi(bitrateStr)
+	if output, err := probeFormat(inputFile, "bit_rate"); err == nil {
+		if bitrate, ok := parseBitrate(output); ok {
+			return bitrate, nil
+		}
+	}
 
+	info, err := os.Stat(inputFile)
 	if err != nil {
-		log.Println("Failed to parse video bitrate: ", err)
-		return "24"
+		return 0, err
 	}
+	duration, err := probeDuration(inputFile)
+	if err != nil {
+		return 0, err
+	}
+	return int(float64(info.Size()) * 8 / duration), nil
+}
+
+func parseBitrate(output string) (int, bool) {
+	bitrate, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil || bitrate <= 0 {
+		return 0, false
+	}
+	return bitrate, true
+}
 
+func crfForBitrate(bitrate int) string {
 	switch {
 	case bitrate >= 2000000:
 		return "48"
@@ -214,6 +1491,7 @@ func calculateCRF(inputFile string) string {
 		return "22"
 	}
 }
+
 func calculateMedian(numbers []int64) int64 {
 	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
 
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPathLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"short", filepath.Join("out", "video.mp4"), false},
+		{"name at limit", filepath.Join("out", strings.Repeat("a", maxNameLength)), false},
+		{"name too long", filepath.Join("out", strings.Repeat("a", maxNameLength+1)), true},
+		{"path too long", strings.Repeat("a"+string(filepath.Separator), maxPathLength/2+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPathLength(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkPathLength(%d bytes) error = %v, wantErr %v", len(tt.path), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	tests := []struct {
+		name string
+		dir  string
+		want string
+	}{
+		{"absolute", root, root},
+		{"trailing slash", root + string(filepath.Separator), root},
+		{"relative", "videos", filepath.Join(wd, "videos")},
+		{"relative with trailing slash", "videos" + string(filepath.Separator), filepath.Join(wd, "videos")},
+		{"dot segments", filepath.Join(root, "a", "..", "b"), filepath.Join(root, "b")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeDir(tt.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeDir(%q) = %q, want %q", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindVideoFilesTrailingSlash(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	in, err := normalizeDir(dir + string(filepath.Separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _, err := findVideoFiles(in, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "a.mp4"); len(files) != 1 || files[0].path != want {
+		t.Errorf("findVideoFiles = %+v, want one file at %s", files, want)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		output string
+		want   float64
+		ok     bool
+	}{
+		{"", 0, false},
+		{"N/A", 0, false},
+		{"N/A\n", 0, false},
+		{"0", 0, false},
+		{"-3.2", 0, false},
+		{"12.5\n", 12.5, true},
+		{"  7200.040000  ", 7200.04, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseDuration(tt.output)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v, %v", tt.output, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPrepareOutputDir(t *testing.T) {
+	root := t.TempDir()
+
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareOutputDir(file); err == nil {
+		t.Errorf("prepareOutputDir(%s) on a regular file succeeded", file)
+	}
+
+	missing := filepath.Join(root, "a", "b")
+	if err := prepareOutputDir(missing); err != nil {
+		t.Fatalf("prepareOutputDir(%s): %v", missing, err)
+	}
+	if info, err := os.Stat(missing); err != nil || !info.IsDir() {
+		t.Errorf("prepareOutputDir did not create %s: %v", missing, err)
+	}
+}
+
+func TestFindVideoFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		dirs  []string
+		want  []string
+	}{
+		{"mp4 only", []string{"a.mp4", "b.mp4"}, nil, []string{"a.mp4", "b.mp4"}},
+		{"non-video files ignored", []string{"a.mp4", "notes.txt", "cover.jpg", "clip.mkv", "mp4"}, nil, []string{"a.mp4"}},
+		{"subdirectories skipped", []string{"a.mp4", filepath.Join("season", "b.mp4")}, []string{"season", "dir.mp4"}, []string{"a.mp4"}},
+		{"uppercase extension not matched", []string{"a.mp4", "B.MP4", "c.Mp4"}, nil, []string{"a.mp4"}},
+		{"empty directory", nil, nil, nil},
+		{"no matching files", []string{"a.txt", "B.MP4"}, []string{"sub"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, file := range tt.files {
+				if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, _, err := findVideoFiles(root, Options{})
+			if err != nil {
+				t.Fatalf("findVideoFiles: %v", err)
+			}
+			var got []string
+			for _, file := range files {
+				if file.path != filepath.Join(root, file.name) {
+					t.Errorf("file %s has path %s", file.name, file.path)
+				}
+				got = append(got, file.name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("findVideoFiles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindVideoFilesMissingDir(t *testing.T) {
+	if _, _, err := findVideoFiles(filepath.Join(t.TempDir(), "missing"), Options{}); err == nil {
+		t.Error("findVideoFiles on a missing directory succeeded")
+	}
+}
+
+func TestPrepareOutputDirReadOnly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory permissions do not prevent writes on Windows")
+	}
+	if os.Getuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+
+	if err := prepareOutputDir(dir); err == nil {
+		t.Errorf("prepareOutputDir(%s) on a read-only directory succeeded", dir)
+	}
+	if err := prepareOutputDir(filepath.Join(dir, "sub")); err == nil {
+		t.Errorf("prepareOutputDir created a directory inside read-only %s", dir)
+	}
+	if _, err := checkOutputDir(filepath.Join(dir, "sub")); err == nil {
+		t.Errorf("checkOutputDir accepted a missing directory under read-only %s", dir)
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		output string
+		want   int
+		ok     bool
+	}{
+		{"", 0, false},
+		{"N/A", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"1500000\n", 1500000, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseBitrate(tt.output)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseBitrate(%q) = %v, %v, want %v, %v", tt.output, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCRFForBitrate(t *testing.T) {
+	tests := []struct {
+		bitrate int
+		want    string
+	}{
+		{0, "22"},
+		{199999, "22"},
+		{200000, "24"},
+		{500000, "24"},
+		{500001, "28"},
+		{999999, "28"},
+		{1000000, "32"},
+		{1499999, "32"},
+		{1500000, "44"},
+		{1999999, "44"},
+		{2000000, "48"},
+		{50000000, "48"},
+	}
+	for _, tt := range tests {
+		if got := crfForBitrate(tt.bitrate); got != tt.want {
+			t.Errorf("crfForBitrate(%d) = %s, want %s", tt.bitrate, got, tt.want)
+		}
+	}
+}
+
+func TestWaitStable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.mp4")
+	if err := os.WriteFile(path, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitStable(path, 10*time.Millisecond); err != nil {
+		t.Fatalf("unchanged file: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done <- os.WriteFile(path, []byte("source, still copying"), 0644)
+	}()
+	err := waitStable(path, 100*time.Millisecond)
+	if werr := <-done; werr != nil {
+		t.Fatal(werr)
+	}
+	if !errors.Is(err, errStillWriting) {
+		t.Errorf("growing file: got %v, want errStillWriting", err)
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+const (
+	maxPathLength = 1024
+	maxNameLength = 255
+)
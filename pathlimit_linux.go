@@ -0,0 +1,6 @@
+package main
+
+const (
+	maxPathLength = 4096
+	maxNameLength = 255
+)
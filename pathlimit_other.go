@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+const (
+	maxPathLength = 1024
+	maxNameLength = 255
+)
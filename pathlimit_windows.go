@@ -0,0 +1,7 @@
+package main
+
+// MAX_PATH is 260 including the terminating NUL.
+const (
+	maxPathLength = 259
+	maxNameLength = 255
+)
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+const pausePollInterval = 5 * time.Second
+
+// waitWhilePaused blocks while pauseFile exists. It returns early with the
+// context's error if ctx is cancelled during the wait.
+func waitWhilePaused(ctx context.Context, pauseFile string) error {
+	if _, err := os.Stat(pauseFile); err != nil {
+		return nil
+	}
+	log.Printf("Paused: %s exists, not starting new encodes until it is removed\n", pauseFile)
+
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := os.Stat(pauseFile); err != nil {
+				log.Printf("Resumed: %s was removed\n", pauseFile)
+				return nil
+			}
+		}
+	}
+}
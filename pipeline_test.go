@@ -0,0 +1,164 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const fakeFFprobe = `#!/bin/sh
+case "$*" in
+*stream=index,codec_type*) echo '{"streams":[{"index":0,"codec_type":"video","codec_name":"h264"},{"index":1,"codec_type":"audio","codec_name":"aac"}]}' ;;
+*stream=bit_rate*) echo 1500000 ;;
+*stream=width,height*) printf '1920\n1080\n' ;;
+*stream=field_order*) echo progressive ;;
+*stream=nb_frames*) echo 1500 ;;
+*stream=duration*) echo 60.000000 ;;
+*) echo N/A ;;
+esac
+`
+
+// fakeFFmpeg writes its last argument, the output file. For inputs named
+// broken* it then fails, leaving the partial output behind the way a real
+// ffmpeg does.
+const fakeFFmpeg = `#!/bin/sh
+for last; do :; done
+printf encoded > "$last"
+case "$*" in
+*broken*) echo "broken: Invalid data found when processing input" >&2; exit 1 ;;
+esac
+`
+
+// installFakeTools puts executable scripts named after the keys of tools
+// first on PATH for the rest of the test.
+func installFakeTools(t *testing.T, tools map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range tools {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// runReenc runs main with args in dir by re-executing the test binary
+// into TestHelperProcess, and returns the exit code. dir is where
+// logfile.log and reference.txt end up.
+func runReenc(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("running reenc: %v\n%s", err, output)
+	}
+	return 0
+}
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"reenc"}, args...)
+	main()
+	os.Exit(0)
+}
+
+func TestPipelineWritesReference(t *testing.T) {
+	installFakeTools(t, map[string]string{"ffprobe": fakeFFprobe, "ffmpeg": fakeFFmpeg})
+	work := t.TempDir()
+	in := filepath.Join(work, "in")
+	out := filepath.Join(work, "out")
+	if err := os.Mkdir(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one.mp4", "two.mp4", "broken.mp4"} {
+		if err := os.WriteFile(filepath.Join(in, name), []byte("source"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code := runReenc(t, work, "-in", in, "-out", out, "-jobs", "2")
+	if code != exitFailures {
+		t.Errorf("exit code %d, want %d (one file fails)", code, exitFailures)
+	}
+
+	data, err := os.ReadFile(filepath.Join(work, "reference.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	sort.Strings(lines)
+	if len(lines) != 2 {
+		t.Fatalf("reference.txt has %d line(s), want 2:\n%s", len(lines), data)
+	}
+	seen := make(map[string]string)
+	for i, want := range []string{"one.mp4", "two.mp4"} {
+		source, output, ok := strings.Cut(lines[i], " - ")
+		if !ok || source != want {
+			t.Errorf("line %q, want source %s", lines[i], want)
+			continue
+		}
+		output, frames, ok := strings.Cut(output, " (frames: ")
+		if !ok || frames != "1500 -> 1500)" {
+			t.Errorf("line %q, want frame counts 1500 -> 1500", lines[i])
+		}
+		if filepath.Dir(output) != out || filepath.Ext(output) != ".mp4" {
+			t.Errorf("line %q, want an .mp4 output in %s", lines[i], out)
+		}
+		if _, err := os.Stat(output); err != nil {
+			t.Errorf("output for %s: %v", source, err)
+		}
+		if other, dup := seen[output]; dup {
+			t.Errorf("%s and %s share output %s", other, source, output)
+		}
+		seen[output] = source
+	}
+
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%s has %d entries, want 2 (no partial output for the failed file)", out, len(entries))
+	}
+}
+
+func TestPipelineNothingToDo(t *testing.T) {
+	installFakeTools(t, map[string]string{"ffprobe": fakeFFprobe, "ffmpeg": fakeFFmpeg})
+	work := t.TempDir()
+	in := filepath.Join(work, "in")
+	out := filepath.Join(work, "out")
+	if err := os.Mkdir(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(in, "new.mp4"), []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := runReenc(t, work, "-in", in, "-out", out, "-min-age", "1"); code != exitOK {
+		t.Errorf("all files filtered out: exit code %d, want %d", code, exitOK)
+	}
+	if code := runReenc(t, work, "-in", filepath.Join(work, "missing"), "-out", out); code != exitUsage {
+		t.Errorf("missing -in: exit code %d, want %d", code, exitUsage)
+	}
+}
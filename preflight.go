@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// runPreflight checks the environment a run depends on without encoding or
+// creating anything, prints what the run would do and returns the exit code.
+// Flags have already been validated by the time it is called.
+func runPreflight(w io.Writer, opts Options, codec Codec, allowConcurrent bool) int {
+	failed := false
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	check := func(name string, err error, detail string) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(tw, "FAIL\t%s\t%v\n", name, err)
+			return
+		}
+		fmt.Fprintf(tw, "ok\t%s\t%s\n", name, detail)
+	}
+
+	check("flags", nil, "valid")
+
+	version, ffmpegErr := toolVersion("ffmpeg")
+	check("ffmpeg", ffmpegErr, version)
+	version, err := toolVersion("ffprobe")
+	check("ffprobe", err, version)
+
+	if ffmpegErr == nil {
+		encoders, err := ffmpegList("-encoders")
+		if err != nil {
+			check("encoders", err, "")
+		} else {
+			check("video encoder", requireListed(encoders, opts.vcodec), opts.vcodec)
+			for _, track := range opts.audioTracks {
+				if track.codec != "copy" {
+					check("audio encoder", requireListed(encoders, track.codec), track.codec)
+				}
+			}
+		}
+
+		var needed []string
+		if opts.deinterlace != "off" {
+			needed = append(needed, "bwdif")
+		}
+		if opts.deband {
+			needed = append(needed, "deband")
+		}
+		if len(needed) > 0 {
+			filters, err := ffmpegList("-filters")
+			for _, filter := range needed {
+				if err == nil {
+					err = requireListed(filters, filter)
+				}
+				check("filter", err, filter)
+			}
+		}
+	}
+
+	if opts.crfCommand != "" {
+		path, err := exec.LookPath(opts.crfCommand)
+		check("crf command", err, path)
+	}
+
+	videoFiles, unreadable, err := findVideoFiles(opts.inDir, opts)
+	var totalSize int64
+	for _, videoFile := range videoFiles {
+		if info, err := os.Stat(videoFile.path); err == nil {
+			totalSize += info.Size()
+		}
+	}
+	check("input", err, fmt.Sprintf("%s: %d file(s), %s, %d unreadable", opts.inDir, len(videoFiles), formatSize(totalSize), unreadable))
+
+	detail, err := checkOutputDir(opts.outDir)
+	check("output", err, detail)
+	check("tmp dir", checkWritable(opts.tmpDir), opts.tmpDir)
+
+	if !allowConcurrent {
+		check("lock", checkLock(".reencode.lock"), "no other instance running here")
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Would encode %d file(s), %s, from %s into %s\n", len(videoFiles), formatSize(totalSize), opts.inDir, opts.outDir)
+	preset := opts.preset
+	if preset == "" {
+		preset = codec.preset
+	}
+	fmt.Fprintf(w, "  video:   %s, preset %s, %s\n", opts.vcodec, preset, crfMode(opts))
+	fmt.Fprintf(w, "  audio:   %s\n", formatAudioTracks(opts.audioTracks))
+	fmt.Fprintf(w, "  jobs:    %d, %d-%d ffmpeg threads each\n", opts.jobs, opts.threadsMin, opts.threadsMax)
+	if opts.maxMemory > 0 {
+		fmt.Fprintf(w, "  memory:  %s budget\n", formatSize(opts.maxMemory))
+	}
+	fmt.Fprintf(w, "  naming:  %s\n", namingMode(opts))
+	if opts.tagSource {
+		fmt.Fprintf(w, "  sources already encoded into %s will be skipped\n", opts.outDir)
+	}
+
+	if failed {
+		fmt.Fprintln(w, "\nPreflight failed")
+		return exitUsage
+	}
+	fmt.Fprintln(w, "\nPreflight passed")
+	return exitOK
+}
+
+func toolVersion(name string) (string, error) {
+	output, err := exec.Command(name, "-version").Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// ffmpegList returns the names from ffmpeg's -encoders or -filters listing,
+// the second column of every line after the legend.
+func ffmpegList(flag string) (map[string]bool, error) {
+	output, err := exec.Command("ffmpeg", "-hide_banner", flag).Output()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			names[fields[1]] = true
+		}
+	}
+	return names, nil
+}
+
+func requireListed(names map[string]bool, name string) error {
+	if !names[name] {
+		return fmt.Errorf("%s is not supported by this ffmpeg build", name)
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".reenc-write-test-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkOutputDir is prepareOutputDir without side effects: a missing
+// directory passes if its closest existing parent is writable.
+func checkOutputDir(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s exists and is not a directory", path)
+		}
+		return path, checkWritable(path)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	parent := filepath.Dir(filepath.Clean(path))
+	for {
+		info, err := os.Stat(parent)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s exists and is not a directory", parent)
+			}
+			return path + " (will be created)", checkWritable(parent)
+		}
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(parent) == parent {
+			return "", err
+		}
+		parent = filepath.Dir(parent)
+	}
+}
+
+func crfMode(opts Options) string {
+	switch {
+	case opts.crf != "":
+		return "CRF " + opts.crf
+	case opts.crfCommand != "":
+		return "CRF from " + opts.crfCommand
+	default:
+		return "bitrate-based CRF, on probe failure " + opts.onProbeFail
+	}
+}
+
+func formatAudioTracks(tracks []AudioTrack) string {
+	var specs []string
+	for _, track := range tracks {
+		spec := track.selector + ":" + track.codec
+		if track.bitrate != "" {
+			spec += ":" + track.bitrate
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, ",")
+}
+
+func namingMode(opts Options) string {
+	switch {
+	case opts.outputTemplate != nil:
+		return "-output-template for matched episodes, <uuid>.mp4 otherwise"
+	case opts.shard:
+		return "<uuid[:2]>/<uuid>.mp4"
+	default:
+		return "<uuid>.mp4"
+	}
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bitrateFFprobe answers bitrate and duration queries from environment
+// variables, N/A when unset.
+const bitrateFFprobe = `#!/bin/sh
+case "$*" in
+*stream=bit_rate*) echo "${STREAM_BIT_RATE:-N/A}" ;;
+*format=bit_rate*) echo "${FORMAT_BIT_RATE:-N/A}" ;;
+*format=duration*) echo "${FORMAT_DURATION:-N/A}" ;;
+*) echo N/A ;;
+esac
+`
+
+func TestProbeBitrateFallbacks(t *testing.T) {
+	installFakeTools(t, map[string]string{"ffprobe": bitrateFFprobe})
+	input := filepath.Join(t.TempDir(), "in.mkv")
+	if err := os.WriteFile(input, make([]byte, 1000000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"stream", map[string]string{"STREAM_BIT_RATE": "3000000", "FORMAT_BIT_RATE": "4000000"}, 3000000, false},
+		{"format", map[string]string{"FORMAT_BIT_RATE": "4000000", "FORMAT_DURATION": "8"}, 4000000, false},
+		{"size and duration", map[string]string{"FORMAT_DURATION": "8"}, 1000000, false},
+		{"nothing", nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"STREAM_BIT_RATE", "FORMAT_BIT_RATE", "FORMAT_DURATION"} {
+				t.Setenv(key, tt.env[key])
+			}
+			got, err := probeBitrate(input)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("probeBitrate = %d, %v, want %d, error %v", got, err, tt.want, tt.wantErr)
+			}
+			crf, err := calculateCRF(input)
+			if tt.wantErr {
+				if err == nil || crf != "24" {
+					t.Errorf("calculateCRF = %s, %v, want 24 and an error", crf, err)
+				}
+			} else if crf != crfForBitrate(tt.want) {
+				t.Errorf("calculateCRF = %s, want %s", crf, crfForBitrate(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var (
+	benchPattern = regexp.MustCompile(`bench: utime=([\d.]+)s stime=([\d.]+)s rtime=([\d.]+)s`)
+	fpsPattern   = regexp.MustCompile(`fps=\s*([\d.]+)`)
+	speedPattern = regexp.MustCompile(`speed=\s*([\d.]+)x`)
+)
+
+type FFmpegProfile struct {
+	UserSeconds   float64 `json:"user_seconds"`
+	SystemSeconds float64 `json:"system_seconds"`
+	RealSeconds   float64 `json:"real_seconds"`
+	FPS           float64 `json:"fps"`
+	Speed         float64 `json:"speed"`
+	// CoresBusy is CPU time over wall time. Well below the cores available
+	// to one encode means ffmpeg spent much of its time waiting on storage
+	// or a single-threaded decoder rather than encoding.
+	CoresBusy float64 `json:"cores_busy"`
+}
+
+// parseFFmpegProfile extracts -benchmark totals and the final progress
+// line's frame rate and speed from ffmpeg's stderr.
+func parseFFmpegProfile(stderr string) *FFmpegProfile {
+	match := benchPattern.FindStringSubmatch(stderr)
+	if match == nil {
+		return nil
+	}
+
+	profile := &FFmpegProfile{}
+	profile.UserSeconds, _ = strconv.ParseFloat(match[1], 64)
+	profile.SystemSeconds, _ = strconv.ParseFloat(match[2], 64)
+	profile.RealSeconds, _ = strconv.ParseFloat(match[3], 64)
+	if profile.RealSeconds > 0 {
+		profile.CoresBusy = (profile.UserSeconds + profile.SystemSeconds) / profile.RealSeconds
+	}
+	if matches := fpsPattern.FindAllStringSubmatch(stderr, -1); len(matches) > 0 {
+		profile.FPS, _ = strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	}
+	if matches := speedPattern.FindAllStringSubmatch(stderr, -1); len(matches) > 0 {
+		profile.Speed, _ = strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	}
+	return profile
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const sourceHashTag = "reencode_source_sha256"
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// indexEncodedSources maps the source hash tagged into each existing output
+// under outDir to that output's path.
+func indexEncodedSources(outDir string) (map[string]string, error) {
+	index := make(map[string]string)
+	err := filepath.WalkDir(outDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Failed to index: %s, error: %v\n", path, err)
+			return nil
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".mp4") {
+			return nil
+		}
+		hash, err := probeSourceHash(path)
+		if err != nil {
+			log.Printf("Failed to read source hash from: %s, error: %v\n", path, err)
+			return nil
+		}
+		if hash != "" {
+			index[hash] = path
+		}
+		return nil
+	})
+	return index, err
+}
+
+// probeSourceHash reads the source hash tag of an output. The tag lives in
+// the format_tags section, which probeFormat's format= entries cannot select.
+func probeSourceHash(path string) (string, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format_tags="+sourceHashTag, "-of", "default=noprint_wrappers=1:nokey=1", filepath.Clean(path))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
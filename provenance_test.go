@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tagFFprobe prints a source hash only when asked for the format_tags
+// entry the way ffprobe would select it, so a malformed query yields an
+// empty index instead of a passing test.
+const tagFFprobe = `#!/bin/sh
+for last; do :; done
+for arg; do
+	if [ "$arg" = "format_tags=reencode_source_sha256" ]; then
+		case "$last" in
+		*tagged*) echo "hash-of-$(basename "$last" .mp4)" ;;
+		esac
+		exit 0
+	fi
+done
+exit 0
+`
+
+func TestIndexEncodedSources(t *testing.T) {
+	installFakeTools(t, map[string]string{"ffprobe": tagFFprobe})
+	out := t.TempDir()
+	if err := os.Mkdir(filepath.Join(out, "ab"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tagged1.mp4", filepath.Join("ab", "tagged2.mp4"), "plain.mp4", "tagged3.txt"} {
+		if err := os.WriteFile(filepath.Join(out, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := indexEncodedSources(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"hash-of-tagged1": filepath.Join(out, "tagged1.mp4"),
+		"hash-of-tagged2": filepath.Join(out, "ab", "tagged2.mp4"),
+	}
+	if len(index) != len(want) {
+		t.Errorf("indexEncodedSources = %v, want %v", index, want)
+	}
+	for hash, path := range want {
+		if index[hash] != path {
+			t.Errorf("index[%s] = %q, want %q", hash, index[hash], path)
+		}
+	}
+}
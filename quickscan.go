@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const quickScanClip = 30.0
+
+// runQuickScan encodes a short clip from every nth file and extrapolates the
+// size-weighted compression ratio of the sample to the whole library.
+func runQuickScan(w io.Writer, videoFiles []VideoFile, every int, opts Options) error {
+	tmpDir, err := os.MkdirTemp(opts.tmpDir, "reenc-scan-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var totalSize, sampleIn, sampleOut float64
+	minRatio, maxRatio := math.Inf(1), math.Inf(-1)
+	sampled := 0
+
+	for i, videoFile := range videoFiles {
+		info, err := os.Stat(videoFile.path)
+		if err != nil {
+			log.Printf("Failed to stat file: %s, error: %v\n", videoFile.path, err)
+			continue
+		}
+		totalSize += float64(info.Size())
+		if i%every != 0 {
+			continue
+		}
+
+		ratio, err := sampleRatio(videoFile, tmpDir, opts)
+		if err != nil {
+			log.Printf("Failed to sample file: %s, error: %v\n", videoFile.path, err)
+			continue
+		}
+		sampled++
+		sampleIn += float64(info.Size())
+		sampleOut += float64(info.Size()) * ratio
+		minRatio = math.Min(minRatio, ratio)
+		maxRatio = math.Max(maxRatio, ratio)
+	}
+
+	if sampled == 0 {
+		return fmt.Errorf("no file could be sampled")
+	}
+
+	ratio := sampleOut / sampleIn
+	estimated := totalSize * ratio
+	fmt.Fprintf(w, "Sampled %d of %d file(s) (%.0f%% of library size), %.0fs clip each\n", sampled, len(videoFiles), 100*sampleIn/totalSize, quickScanClip)
+	fmt.Fprintf(w, "Library size: %s\n", formatSize(int64(totalSize)))
+	fmt.Fprintf(w, "Estimated output: %s (%.1f%% of input, per-file range %.1f%%-%.1f%%)\n", formatSize(int64(estimated)), 100*ratio, 100*minRatio, 100*maxRatio)
+	fmt.Fprintf(w, "Estimated savings: %s\n", formatSize(int64(totalSize-estimated)))
+	return nil
+}
+
+func sampleRatio(videoFile VideoFile, tmpDir string, opts Options) (float64, error) {
+	duration, err := probeDuration(videoFile.path)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(videoFile.path)
+	if err != nil {
+		return 0, err
+	}
+	crf, err := chooseCRF(videoFile.path, opts)
+	if err != nil {
+		return 0, err
+	}
+	audio, err := resolveAudioTracks(videoFile.path, opts.audioTracks)
+	if err != nil {
+		return 0, err
+	}
+
+	clip := math.Min(quickScanClip, duration)
+	start := (duration - clip) / 2
+	outputFile := filepath.Join(tmpDir, "sample.mp4")
+	defer os.Remove(outputFile)
+
+	args := []string{"-ss", strconv.FormatFloat(start, 'f', 3, 64), "-t", strconv.FormatFloat(clip, 'f', 3, 64)}
+	args = append(args, ffmpegArgs(videoFile.path, crf, outputFile, videoFilters(videoFile.path, opts), audio, nil, opts)...)
+	if _, err := runFFMPEGCommand(context.Background(), tmpDir, args); err != nil {
+		return 0, err
+	}
+
+	out, err := os.Stat(outputFile)
+	if err != nil {
+		return 0, err
+	}
+	clipIn := float64(info.Size()) * clip / duration
+	return float64(out.Size()) / clipIn, nil
+}
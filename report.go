@@ -0,0 +1,112 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"size": formatSize,
+	"base": filepath.Base,
+	"saved": func(result Result) int64 {
+		return result.InSize - result.OutSize
+	},
+	"percent": func(part, whole int64) float64 {
+		if whole == 0 {
+			return 0
+		}
+		return 100 * float64(part) / float64(whole)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>reenc report {{.Generated.Format "2006-01-02 15:04"}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: 4px 8px; border-bottom: 1px solid #ddd; text-align: right; }
+th { cursor: pointer; background: #f4f4f4; }
+td:first-child, th:first-child { text-align: left; }
+.bar { height: 1.2em; background: #4a90d9; }
+.bar.out { background: #7cb342; }
+.chart td { border: none; }
+</style>
+</head>
+<body>
+<h1>Encode report</h1>
+<p>{{len .Results}} file(s), generated {{.Generated.Format "2006-01-02 15:04:05"}}</p>
+
+<h2>Total savings: {{size .Saved}} ({{printf "%.1f" (percent .Saved .TotalIn)}}%)</h2>
+<table class="chart">
+<tr><td>Input</td><td style="width:80%"><div class="bar" style="width:100%"></div></td><td>{{size .TotalIn}}</td></tr>
+<tr><td>Output</td><td style="width:80%"><div class="bar out" style="width:{{printf "%.1f" (percent .TotalOut .TotalIn)}}%"></div></td><td>{{size .TotalOut}}</td></tr>
+</table>
+
+<h2>Files</h2>
+<table id="files">
+<thead><tr><th>Source</th><th>Output</th><th>CRF</th><th>Input</th><th>Output size</th><th>Saved</th><th>Encode time</th><th>DTS warnings</th></tr></thead>
+<tbody>
+{{range .Results}}<tr>
+<td>{{base .Source}}</td><td>{{base .Output}}</td><td>{{.CRF}}</td>
+<td data-value="{{.InSize}}">{{size .InSize}}</td>
+<td data-value="{{.OutSize}}">{{size .OutSize}}</td>
+<td data-value="{{percent (saved .) .InSize}}">{{printf "%.1f" (percent (saved .) .InSize)}}%</td>
+<td data-value="{{.EncodeSeconds}}">{{printf "%.0f" .EncodeSeconds}}s</td>
+<td data-value="{{.DTSWarnings}}">{{.DTSWarnings}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{if .ProbeSkipped}}
+<h2>Skipped: bitrate could not be probed</h2>
+<ul>
+{{range .ProbeSkipped}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}
+<script>
+document.querySelectorAll("#files th").forEach(function (th, column) {
+  var ascending = true;
+  th.addEventListener("click", function () {
+    var body = document.querySelector("#files tbody");
+    var rows = Array.from(body.rows);
+    rows.sort(function (a, b) {
+      var x = a.cells[column], y = b.cells[column];
+      var xv = x.dataset.value !== undefined ? parseFloat(x.dataset.value) : x.textContent;
+      var yv = y.dataset.value !== undefined ? parseFloat(y.dataset.value) : y.textContent;
+      return (xv < yv ? -1 : xv > yv ? 1 : 0) * (ascending ? 1 : -1);
+    });
+    ascending = !ascending;
+    rows.forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+func writeHTMLReport(path string, results []Result, probeSkipped []string) error {
+	data := struct {
+		Generated         time.Time
+		Results           []Result
+		ProbeSkipped      []string
+		TotalIn, TotalOut int64
+		Saved             int64
+	}{Generated: time.Now(), Results: results, ProbeSkipped: probeSkipped}
+	for _, result := range results {
+		data.TotalIn += result.InSize
+		data.TotalOut += result.OutSize
+	}
+	data.Saved = data.TotalIn - data.TotalOut
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
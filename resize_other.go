@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "github.com/schollz/progressbar/v3"
+
+func watchResize(progressBar *progressbar.ProgressBar) func() {
+	return func() {}
+}
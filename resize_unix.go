@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const resizeSettle = 100 * time.Millisecond
+
+func watchResize(progressBar *progressbar.ProgressBar) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	done := make(chan struct{})
+
+	// A resize sends a burst of SIGWINCH and renders are throttled, so
+	// the last signals of a burst would be dropped. Render once the burst
+	// has settled for longer than the throttle interval instead.
+	settle := time.NewTimer(time.Hour)
+	settle.Stop()
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				settle.Reset(resizeSettle)
+			case <-settle.C:
+				progressBar.Describe("")
+			case <-done:
+				settle.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
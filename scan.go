@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+type LibraryEntry struct {
+	Path     string   `json:"path"`
+	Size     int64    `json:"size"`
+	Duration float64  `json:"duration,omitempty"`
+	Bitrate  int      `json:"bitrate,omitempty"`
+	Codec    string   `json:"codec,omitempty"`
+	Width    int      `json:"width,omitempty"`
+	Height   int      `json:"height,omitempty"`
+	Streams  []Stream `json:"streams,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// scanLibrary probes every file and writes the results as one JSON array.
+// Probe errors are reported per entry so one bad file does not hide the rest.
+func scanLibrary(w io.Writer, videoFiles []VideoFile) error {
+	entries := make([]LibraryEntry, 0, len(videoFiles))
+	for _, videoFile := range videoFiles {
+		entry := LibraryEntry{Path: videoFile.path}
+		info, err := os.Stat(videoFile.path)
+		if err != nil {
+			entry.Error = err.Error()
+			entries = append(entries, entry)
+			continue
+		}
+		entry.Size = info.Size()
+
+		entry.Streams, err = probeStreams(videoFile.path)
+		if err != nil {
+			entry.Error = err.Error()
+			entries = append(entries, entry)
+			continue
+		}
+		for _, stream := range entry.Streams {
+			if stream.CodecType == "video" {
+				entry.Codec = stream.CodecName
+				break
+			}
+		}
+		entry.Duration, _ = probeDuration(videoFile.path)
+		entry.Bitrate, _ = probeBitrate(videoFile.path)
+		entry.Width, entry.Height, _ = probeResolution(videoFile.path)
+		entries = append(entries, entry)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A sheet of spriteColumns x spriteRows thumbnails stays far below JPEG's
+// 65535 pixel limit; long videos get several sheets.
+const (
+	spriteColumns    = 10
+	spriteRows       = 10
+	spriteThumbWidth = 160
+)
+
+// writeSprites renders thumbnails of videoFile every interval into tiled
+// JPEG sheets and writes a WebVTT file mapping each time range to its tile.
+func writeSprites(videoFile string, interval time.Duration) error {
+	duration, err := probeDuration(videoFile)
+	if err != nil {
+		return err
+	}
+	width, height, err := probeResolution(videoFile)
+	if err != nil {
+		return err
+	}
+
+	step := interval.Seconds()
+	count := int(math.Ceil(duration / step))
+	rows := (count + spriteColumns - 1) / spriteColumns
+	if rows > spriteRows {
+		rows = spriteRows
+	}
+	perSheet := spriteColumns * rows
+	thumbHeight := (spriteThumbWidth*height/width + 1) &^ 1
+
+	base := strings.TrimSuffix(videoFile, filepath.Ext(videoFile))
+	spritePattern := base + ".sprite-%03d.jpg"
+	vttFile := base + ".vtt"
+
+	filter := fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", step, spriteThumbWidth, thumbHeight, spriteColumns, rows)
+	cmd := exec.Command("ffmpeg", "-y", "-i", videoFile, "-vf", filter, "-q:v", "4", "-start_number", "0", spritePattern)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i := 0; i < count; i++ {
+		start := float64(i) * step
+		end := math.Min(start+step, duration)
+		sheet := filepath.Base(fmt.Sprintf(spritePattern, i/perSheet))
+		x := (i % spriteColumns) * spriteThumbWidth
+		y := (i % perSheet / spriteColumns) * thumbHeight
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTimestamp(start), vttTimestamp(end), sheet, x, y, spriteThumbWidth, thumbHeight)
+	}
+	return ioutil.WriteFile(vttFile, []byte(vtt.String()), 0644)
+}
+
+func vttTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
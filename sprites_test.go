@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSpritesSplitsSheets(t *testing.T) {
+	installFakeTools(t, map[string]string{"ffprobe": fakeFFprobe, "ffmpeg": fakeFFmpeg})
+	video := filepath.Join(t.TempDir(), "out.mp4")
+
+	// 60s at 0.5s intervals is 120 thumbnails: one full sheet and one with 20.
+	if err := writeSprites(video, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(strings.TrimSuffix(video, ".mp4") + ".vtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, "#xywh=") {
+			refs = append(refs, line)
+		}
+	}
+	if len(refs) != 120 {
+		t.Fatalf("%d cues, want 120", len(refs))
+	}
+	for i, want := range map[int]string{
+		0:   "out.sprite-000.jpg#xywh=0,0,160,90",
+		99:  "out.sprite-000.jpg#xywh=1440,810,160,90",
+		100: "out.sprite-001.jpg#xywh=0,0,160,90",
+		119: "out.sprite-001.jpg#xywh=1440,90,160,90",
+	} {
+		if refs[i] != want {
+			t.Errorf("cue %d = %q, want %q", i, refs[i], want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type LifetimeStats struct {
+	Runs           int       `json:"runs"`
+	FilesProcessed int64     `json:"files_processed"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	LastRun        time.Time `json:"last_run"`
+}
+
+func updateLifetimeStats(path string, results []Result) (LifetimeStats, error) {
+	var stats LifetimeStats
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return stats, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return stats, err
+		}
+	}
+
+	stats.Runs++
+	stats.LastRun = time.Now()
+	for _, result := range results {
+		stats.FilesProcessed++
+		stats.BytesIn += result.InSize
+		stats.BytesOut += result.OutSize
+	}
+
+	data, err = json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return stats, err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(tmp, path)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type Stream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	BitRate   string `json:"bit_rate"`
+	Tags      struct {
+		Language string `json:"language"`
+	} `json:"tags"`
+}
+
+func probeStreams(inputFile string) ([]Stream, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=index,codec_type,codec_name,bit_rate:stream_tags=language", "-of", "json", filepath.Clean(inputFile))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var probe struct {
+		Streams []Stream `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+	return probe.Streams, nil
+}
+
+func listStreams(w io.Writer, videoFiles []VideoFile) {
+	for _, videoFile := range videoFiles {
+		fmt.Fprintf(w, "%s\n", videoFile.path)
+
+		streams, err := probeStreams(videoFile.path)
+		if err != nil {
+			fmt.Fprintf(w, "  error: %v\n\n", err)
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  INDEX\tTYPE\tCODEC\tLANGUAGE\tBITRATE")
+		for _, stream := range streams {
+			fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\t%s\n", stream.Index, stream.CodecType, stream.CodecName, orDash(stream.Tags.Language), formatBitrate(stream.BitRate))
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+}
+
+func formatBitrate(bitRate string) string {
+	bps, err := strconv.Atoi(bitRate)
+	if err != nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d kb/s", bps/1000)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
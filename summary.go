@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+type Summary struct {
+	Generated time.Time `json:"generated"`
+	Files     []string  `json:"files"`
+	Encoded   int       `json:"encoded"`
+	Failed    int       `json:"failed"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+
+	ProbeSkipped []string `json:"probe_skipped,omitempty"`
+}
+
+func newSummary(results []Result, failed int) Summary {
+	summary := Summary{Generated: time.Now(), Encoded: len(results), Failed: failed}
+	for _, result := range results {
+		summary.Files = append(summary.Files, result.Source)
+		summary.BytesIn += result.InSize
+		summary.BytesOut += result.OutSize
+	}
+	return summary
+}
+
+func (s Summary) saved() int64 {
+	return s.BytesIn - s.BytesOut
+}
+
+func writeSummary(path string, summary Summary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func loadSummary(path string) (Summary, error) {
+	var summary Summary
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return summary, err
+	}
+	err = json.Unmarshal(data, &summary)
+	return summary, err
+}
+
+func printSummaryComparison(w io.Writer, previous, current Summary) {
+	seen := make(map[string]bool, len(previous.Files))
+	for _, file := range previous.Files {
+		seen[file] = true
+	}
+	added := 0
+	for _, file := range current.Files {
+		if !seen[file] {
+			added++
+		}
+	}
+
+	fmt.Fprintf(w, "\nCompared to run of %s:\n", previous.Generated.Format("2006-01-02 15:04"))
+	fmt.Fprintf(w, "  Files encoded: %d (%+d), %d not in previous run\n", current.Encoded, current.Encoded-previous.Encoded, added)
+	fmt.Fprintf(w, "  Saved: %s (previously %s, delta %s)\n", formatSize(current.saved()), formatSize(previous.saved()), signedSize(current.saved()-previous.saved()))
+	fmt.Fprintf(w, "  Failures: %d (%+d)\n", current.Failed, current.Failed-previous.Failed)
+}
+
+func signedSize(size int64) string {
+	if size < 0 {
+		return "-" + formatSize(-size)
+	}
+	return "+" + formatSize(size)
+}
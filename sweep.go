@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func parseCRFRange(value string, maxCRF int) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected LOW-HIGH, got %q", value)
+	}
+	low, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if low < 0 || high > maxCRF || low > high {
+		return 0, 0, fmt.Errorf("range must be within 0-%d with LOW <= HIGH", maxCRF)
+	}
+	return low, high, nil
+}
+
+// runSweep encodes videoFile once per CRF in [low, high] and prints the
+// resulting sizes. Outputs go to a temporary directory and are removed.
+func runSweep(w io.Writer, videoFile VideoFile, low, high, step int, opts Options) error {
+	tmpDir, err := os.MkdirTemp(opts.tmpDir, "reenc-sweep-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fmt.Fprintf(w, "%s\n", videoFile.path)
+
+	info, err := os.Stat(videoFile.path)
+	if err != nil {
+		return err
+	}
+	audio, err := resolveAudioTracks(videoFile.path, opts.audioTracks)
+	if err != nil {
+		return err
+	}
+	filters := videoFilters(videoFile.path, opts)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  CRF\tSIZE\tOF SOURCE\tENCODE TIME")
+	for crf := low; crf <= high; crf += step {
+		outputFile := filepath.Join(tmpDir, strconv.Itoa(crf)+".mp4")
+		args := ffmpegArgs(videoFile.path, strconv.Itoa(crf), outputFile, filters, audio, nil, opts)
+
+		start := time.Now()
+		if _, err := runFFMPEGCommand(context.Background(), tmpDir, args); err != nil {
+			log.Printf("Failed to encode file: %s at CRF %d, error: %v\n", videoFile.path, crf, err)
+			fmt.Fprintf(tw, "  %d\tfailed\t\t\n", crf)
+			continue
+		}
+		elapsed := time.Since(start).Round(time.Second)
+
+		out, err := os.Stat(outputFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "  %d\t%s\t%.1f%%\t%s\n", crf, formatSize(out.Size()), 100*float64(out.Size())/float64(info.Size()), elapsed)
+		os.Remove(outputFile)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSweepEncodesOneFile(t *testing.T) {
+	installFakeTools(t, map[string]string{"ffprobe": fakeFFprobe, "ffmpeg": fakeFFmpeg})
+	tmp := t.TempDir()
+	source := filepath.Join(t.TempDir(), "source.mp4")
+	if err := os.WriteFile(source, []byte("source file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{tmpDir: tmp, audioTracks: defaultAudioTracks, vcodec: "libx265", deinterlace: "off", threadsMin: 1, threadsMax: 1}
+
+	var out bytes.Buffer
+	if err := runSweep(&out, VideoFile{path: source, name: "source.mp4"}, 20, 24, 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || lines[0] != source {
+		t.Fatalf("output:\n%s\nwant the source, a header and rows for CRF 20, 22 and 24", out.String())
+	}
+	for i, crf := range []string{"20", "22", "24"} {
+		if fields := strings.Fields(lines[i+2]); len(fields) == 0 || fields[0] != crf || fields[1] == "failed" {
+			t.Errorf("row %q, want an encoded size for CRF %s", lines[i+2], crf)
+		}
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("-tmp-dir has %d leftover entries", len(entries))
+	}
+}